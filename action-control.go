@@ -0,0 +1,120 @@
+package gcp
+
+//This file will contain the cancellation and the new trigger of stored actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// ActionCancel closes all the open notifications of the action as cancelled and publishes
+// the cancellation to the devices still being reached, queued or delivered; the devices that
+// failed or timed out are left alone. It returns the number of notifications closed.
+func (d *Dispatcher) ActionCancel(ctx context.Context, acID string) (int, error) {
+	notifications, err := NotificationsGetByAcID(ctx, d.ds, acID)
+	if err != nil {
+		return 0, err
+	}
+	levels, err := d.deviceLevels(ctx, acID)
+	if err != nil {
+		return 0, err
+	}
+	closed := 0
+	for _, n := range notifications {
+		// get the devices before closing, the events are kept afterwards
+		events, err := EventsGetByNtID(ctx, d.ds, n.NtID)
+		if err != nil {
+			return closed, err
+		}
+		err = NotificationClose(ctx, d.ds, n.NtID, EvSubTypeCancelled)
+		if errors.Is(err, ErrNotificationClosed) {
+			continue
+		}
+		if err != nil {
+			return closed, err
+		}
+		closed++
+		states := deviceStates(events)
+		sent := make(map[string]bool)
+		for _, e := range events {
+			if e.DvID == "" || sent[e.DvID] || !beingReached(states[e.DvID]) {
+				continue
+			}
+			sent[e.DvID] = true
+			if err = d.publish(ctx, MessageKindCancel, n, e.DvID, levels[e.DvID]); err != nil {
+				return closed, err
+			}
+		}
+	}
+	logger().InfoContext(ctx, "action cancelled", LogKeyOp, "ActionCancel", LogKeyKind, dst.KindActions, LogKeyBusinessID, acID, LogKeyCount, closed)
+	return closed, nil
+}
+
+// beingReached reports if a device in the state (see deviceStates) may still show the notification
+func beingReached(state string) bool {
+	switch state {
+	case EvTypeServices, EvSubTypeReaching, EvSubTypeDelivered:
+		return true
+	}
+	return false
+}
+
+// deviceLevels returns the lowest level each device is assigned at on the callpoint of the action
+func (d *Dispatcher) deviceLevels(ctx context.Context, acID string) (map[string]int, error) {
+	levels := make(map[string]int)
+	actions, err := ActionGetByAcID(ctx, d.ds, acID)
+	if err != nil || len(actions) <= 0 {
+		return levels, err
+	}
+	assignments, err := AssignmentsByCpID(ctx, d.ds, actions[0].CpID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assignments {
+		if level, ok := levels[a.DvID]; !ok || a.Level < level {
+			levels[a.DvID] = a.Level
+		}
+	}
+	return levels, nil
+}
+
+// ActionRetrigger dispatches the stored action again, with a fresh notification linked to the same acID.
+// The handle Retry counter is the number of notifications the action had before, and is stored
+// as a NotificationRetry of the new notification.
+func (d *Dispatcher) ActionRetrigger(ctx context.Context, acID string) (*DispatchHandle, error) {
+	logger().InfoContext(ctx, "retriggering action", LogKeyOp, "ActionRetrigger", LogKeyKind, dst.KindActions, LogKeyBusinessID, acID)
+	actions, err := ActionGetByAcID(ctx, d.ds, acID)
+	if err != nil {
+		return nil, err
+	}
+	if len(actions) <= 0 {
+		return nil, fmt.Errorf("action not found. acID: %s", acID)
+	}
+	previous, err := NotificationsGetByAcID(ctx, d.ds, acID)
+	if err != nil {
+		return nil, err
+	}
+	h, err := d.Dispatch(ctx, actions[0])
+	if err != nil {
+		return nil, err
+	}
+	h.Retry = len(previous)
+	_, err = EventAdd(ctx, d.ds, &dst.Event{
+		NtID:          h.NtID,
+		CpID:          h.CpID,
+		Visibility:    VisibilityServer,
+		EvType:        EvTypeStart,
+		EvSubType:     EvSubTypeRetry,
+		EvDescription: fmt.Sprintf("retry %d of action %s", h.Retry, acID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = NotificationRetrySet(ctx, d.ds, &NotificationRetry{NtID: h.NtID, AcID: acID, Retry: h.Retry}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,130 @@
+package gcp
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub/pstest"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// cancels returns the devices the cancellation of the notification was published to
+func cancels(srv *pstest.Server, ntID string) []string {
+	var dvIDs []string
+	for _, m := range srv.Messages() {
+		if m.Attributes[AttrNtID] == ntID && m.Attributes[AttrKind] == MessageKindCancel {
+			dvIDs = append(dvIDs, m.Attributes[AttrDvID])
+		}
+	}
+	sort.Strings(dvIDs)
+	return dvIDs
+}
+
+func TestActionCancel(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, srv := newTestDispatcher(ctx, t, client)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+	for _, dvID := range []string{"dv-1", "dv-2", "dv-3", "dv-4"} {
+		addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: dvID}, 1)
+	}
+	h, err := d.Dispatch(ctx, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dv-1 stays queued, dv-2 is delivered, dv-3 failed and dv-4 timed out
+	for dvID, subType := range map[string]string{"dv-2": EvSubTypeDelivered, "dv-3": EvSubTypeFailed, "dv-4": EvSubTypeTimeout} {
+		if err = recordDelivery(ctx, client, &dst.Device{DvID: dvID}, &dst.Notification{NtID: h.NtID}, subType, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed, err := d.ActionCancel(ctx, ac.AcID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed != 1 {
+		t.Fatalf("closed = %d, want 1", closed)
+	}
+	if got := strings.Join(cancels(srv, h.NtID), ","); got != "dv-1,dv-2" {
+		t.Fatalf("cancellations sent to %s, want dv-1,dv-2", got)
+	}
+	if s, err := h.Status(ctx); err != nil || !s.Ended {
+		t.Fatalf("status after cancel = %+v, %v; want ended", s, err)
+	}
+	// the closed notification is not cancelled again
+	if closed, err = d.ActionCancel(ctx, ac.AcID); err != nil || closed != 0 {
+		t.Fatalf("second ActionCancel = %d, %v; want 0", closed, err)
+	}
+	if got := len(cancels(srv, h.NtID)); got != 2 {
+		t.Fatalf("%d cancellations after the second cancel, want 2", got)
+	}
+}
+
+func TestActionRetrigger(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, srv := newTestDispatcher(ctx, t, client)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+	first, err := d.Dispatch(ctx, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := NotificationRetryGet(ctx, client, first.NtID); err != nil || r != nil {
+		t.Fatalf("retry of the first notification = %+v, %v; want none", r, err)
+	}
+
+	var handles []*DispatchHandle
+	for i := 0; i < 2; i++ {
+		h, err := d.ActionRetrigger(ctx, ac.AcID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.NtID == first.NtID || h.Retry != i+1 {
+			t.Fatalf("retrigger %d = %+v, want a new notification with retry %d", i, h, i+1)
+		}
+		if got := jobs(srv, h.NtID); len(got) != 1 || got["dv-1"] != "1" {
+			t.Fatalf("jobs of retrigger %d = %v, want dv-1 at level 1", i, got)
+		}
+		handles = append(handles, h)
+	}
+	r, err := NotificationRetryGet(ctx, client, handles[1].NtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.AcID != ac.AcID || r.Retry != 2 {
+		t.Fatalf("retry = %+v, want retry 2 of %s", r, ac.AcID)
+	}
+	retries, err := NotificationRetriesByAcID(ctx, client, ac.AcID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retries) != 2 || retries[0].NtID != handles[0].NtID || retries[1].NtID != handles[1].NtID {
+		t.Fatalf("retries = %+v, want the two retriggered notifications in order", retries)
+	}
+}
+
+func TestActionRetriggerUnknownAction(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, _ := newTestDispatcher(ctx, t, client)
+	if _, err := d.ActionRetrigger(ctx, "ac-gone"); err == nil {
+		t.Fatal("ActionRetrigger of an unknown action, want error")
+	}
+}
+
+func TestBeingReached(t *testing.T) {
+	for state, want := range map[string]bool{
+		EvTypeServices:     true,
+		EvSubTypeReaching:  true,
+		EvSubTypeDelivered: true,
+		EvSubTypeFailed:    false,
+		EvSubTypeTimeout:   false,
+		EvSubTypeReply:     false,
+		"":                 false,
+	} {
+		if got := beingReached(state); got != want {
+			t.Errorf("beingReached(%q) = %v, want %v", state, got, want)
+		}
+	}
+}
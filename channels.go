@@ -0,0 +1,255 @@
+package gcp
+
+//This file will contain the delivery channels used to reach the devices
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// DeliveryResult is the outcome of a delivery to a device
+type DeliveryResult struct {
+	Delivered bool
+	Detail    string
+}
+
+// Channel reaches a device with a notification
+type Channel interface {
+	Deliver(ctx context.Context, dv *dst.Device, n *dst.Notification) (*DeliveryResult, error)
+}
+
+// ChannelRegistry holds the channel of each device category and type
+type ChannelRegistry struct {
+	mu         sync.RWMutex
+	byCategory map[string]Channel
+	byType     map[int]Channel
+	watchdog   *Watchdog
+}
+
+// NewChannelRegistry returns a registry with the webhook channel for DvCategoryWebhook.
+// The email channel needs an SMTP server, so it must be registered by the caller.
+func NewChannelRegistry() *ChannelRegistry {
+	r := &ChannelRegistry{
+		byCategory: make(map[string]Channel),
+		byType:     make(map[int]Channel),
+	}
+	r.RegisterCategory(DvCategoryWebhook, &WebhookChannel{})
+	return r
+}
+
+// RegisterCategory sets the channel used for devices of the given category
+func (r *ChannelRegistry) RegisterCategory(category string, c Channel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byCategory[category] = c
+}
+
+// RegisterType sets the channel used for devices of the given type, when their category has no channel
+func (r *ChannelRegistry) RegisterType(dvType int, c Channel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byType[dvType] = c
+}
+
+// SetWatchdog sets the watchdog told when a device is delivered or failed, so it stops tracking it
+func (r *ChannelRegistry) SetWatchdog(w *Watchdog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watchdog = w
+}
+
+// done stops the watchdog tracking the device, if any
+func (r *ChannelRegistry) done(dv *dst.Device, n *dst.Notification) {
+	r.mu.RLock()
+	w := r.watchdog
+	r.mu.RUnlock()
+	if w != nil {
+		w.Done(n.NtID, dv.DvID)
+	}
+}
+
+// Lookup returns the channel for the device, by category first and then by type
+func (r *ChannelRegistry) Lookup(dv *dst.Device) (Channel, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.byCategory[dv.Category]; ok {
+		return c, true
+	}
+	c, ok := r.byType[dv.Type]
+	return c, ok
+}
+
+// Deliver reaches the device through its channel and records the reaching, delivered or failed events.
+// With SetWatchdog, the device is no longer tracked by the watchdog once delivered or failed.
+func (r *ChannelRegistry) Deliver(ctx context.Context, client *datastore.Client, dv *dst.Device, n *dst.Notification) (*DeliveryResult, error) {
+	c, ok := r.Lookup(dv)
+	if !ok {
+		res := &DeliveryResult{Detail: fmt.Sprintf("no channel for category '%s' type %d", dv.Category, dv.Type)}
+		metrics().DeviceOutcome(dv.Type, EvSubTypeFailed)
+		r.done(dv, n)
+		return res, recordDelivery(ctx, client, dv, n, EvSubTypeFailed, res.Detail)
+	}
+	if err := recordDelivery(ctx, client, dv, n, EvSubTypeReaching, dv.Destination); err != nil {
+		return nil, err
+	}
+	res, err := c.Deliver(ctx, dv, n)
+	if err == nil && res == nil {
+		err = fmt.Errorf("channel for category '%s' type %d returned no result", dv.Category, dv.Type)
+	}
+	if err != nil {
+		res = &DeliveryResult{Detail: err.Error()}
+	}
+	subType := EvSubTypeFailed
+	if res.Delivered {
+		subType = EvSubTypeDelivered
+	}
+	metrics().DeviceOutcome(dv.Type, subType)
+	r.done(dv, n)
+	logger().InfoContext(ctx, "delivery", LogKeyOp, "Deliver", LogKeyKind, dst.KindDevices, LogKeyBusinessID, dv.DvID, "ntID", n.NtID, "result", subType, "detail", res.Detail)
+	return res, recordDelivery(ctx, client, dv, n, subType, res.Detail)
+}
+
+// recordDelivery adds a devices event for the notification
+func recordDelivery(ctx context.Context, client *datastore.Client, dv *dst.Device, n *dst.Notification, subType, description string) error {
+	_, err := EventAdd(ctx, client, &dst.Event{
+		NtID:          n.NtID,
+		DvID:          dv.DvID,
+		Visibility:    VisibilityAll,
+		EvType:        EvTypeDevices,
+		EvSubType:     subType,
+		EvDescription: description,
+	})
+	return err
+}
+
+// WebhookChannel posts the notification as JSON to the device destination URL
+type WebhookChannel struct {
+	// Client is the http client to use. If nil, http.DefaultClient is used
+	Client *http.Client
+}
+
+// Deliver posts the notification. Any 2xx response is a delivery
+func (c *WebhookChannel) Deliver(ctx context.Context, dv *dst.Device, n *dst.Notification) (*DeliveryResult, error) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, dv.Destination, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook destination '%s'. %v", dv.Destination, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	hc := c.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return &DeliveryResult{
+		Delivered: resp.StatusCode >= 200 && resp.StatusCode < 300,
+		Detail:    resp.Status,
+	}, nil
+}
+
+// EmailChannel sends the notification by email to the device destination address
+type EmailChannel struct {
+	// Addr is the SMTP server host:port
+	Addr string
+	From string
+	// Auth is optional, for servers that need authentication
+	Auth smtp.Auth
+}
+
+// headerReplacer removes the line breaks that would end a header and start another one
+var headerReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Deliver sends the email. The delivery is done once the SMTP server accepts it
+func (c *EmailChannel) Deliver(ctx context.Context, dv *dst.Device, n *dst.Notification) (*DeliveryResult, error) {
+	if dv.Destination == "" {
+		return &DeliveryResult{Detail: "device has no destination address"}, nil
+	}
+	if strings.ContainsAny(dv.Destination, "\r\n") {
+		return &DeliveryResult{Detail: "device destination address has a line break"}, nil
+	}
+	subject := headerReplacer.Replace(n.ResponseTitle)
+	if subject == "" {
+		subject = "Notification " + n.NtID
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", dv.Destination)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "\r\n%s\r\n", n.Message)
+	if err := c.send(ctx, dv.Destination, []byte(msg.String())); err != nil {
+		return nil, err
+	}
+	return &DeliveryResult{Delivered: true, Detail: "accepted by " + c.Addr}, nil
+}
+
+// send works as smtp.SendMail, but gives up when ctx is done
+func (c *EmailChannel) send(ctx context.Context, to string, msg []byte) (err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	// closing the connection interrupts a server that does not answer
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		if !stop() && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	host, _, _ := net.SplitHostPort(c.Addr)
+	sc, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer sc.Close()
+	if ok, _ := sc.Extension("STARTTLS"); ok {
+		if err = sc.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if c.Auth != nil {
+		if ok, _ := sc.Extension("AUTH"); ok {
+			if err = sc.Auth(c.Auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err = sc.Mail(c.From); err != nil {
+		return err
+	}
+	if err = sc.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := sc.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return sc.Quit()
+}
@@ -0,0 +1,162 @@
+package gcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestWebhookChannel(t *testing.T) {
+	var got dst.Notification
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	ch := &WebhookChannel{Client: srv.Client()}
+	dv := &dst.Device{DvID: "dv-1", Destination: srv.URL}
+	n := &dst.Notification{NtID: "nt-1", Message: "room 12"}
+
+	res, err := ch.Deliver(context.Background(), dv, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Delivered || got.NtID != "nt-1" {
+		t.Fatalf("Deliver = %+v, posted %+v; want delivered nt-1", res, got)
+	}
+	status = http.StatusServiceUnavailable
+	if res, err = ch.Deliver(context.Background(), dv, n); err != nil || res.Delivered {
+		t.Fatalf("Deliver on %d = %+v, %v; want not delivered", status, res, err)
+	}
+}
+
+// fakeSMTP is an SMTP server that accepts every message, or never answers when silent
+type fakeSMTP struct {
+	ln     net.Listener
+	silent bool
+	msgs   chan string
+}
+
+func newFakeSMTP(t *testing.T, silent bool) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, silent: silent, msgs: make(chan string, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *fakeSMTP) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if s.silent {
+		r.ReadString('\n')
+		return
+	}
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.msgs <- data.String()
+			reply("250 queued")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestEmailChannel(t *testing.T) {
+	srv := newFakeSMTP(t, false)
+	ch := &EmailChannel{Addr: srv.ln.Addr().String(), From: "alarms@example.com"}
+	n := &dst.Notification{NtID: "nt-1", ResponseTitle: "Fall\r\nBcc: evil@example.com", Message: "room 12"}
+
+	res, err := ch.Deliver(context.Background(), &dst.Device{Destination: "nurse@example.com"}, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Delivered {
+		t.Fatalf("Deliver = %+v, want delivered", res)
+	}
+	msg := <-srv.msgs
+	headers := msg[:strings.Index(msg, "\r\n\r\n")]
+	for _, h := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(h, "Bcc:") {
+			t.Fatalf("injected header in:\n%s", headers)
+		}
+	}
+	if !strings.Contains(headers, "Subject: Fall  Bcc: evil@example.com") {
+		t.Fatalf("subject not on one line in:\n%s", headers)
+	}
+
+	res, err = ch.Deliver(context.Background(), &dst.Device{Destination: "nurse@example.com\r\nBcc: evil@example.com"}, n)
+	if err != nil || res.Delivered {
+		t.Fatalf("Deliver to a destination with a line break = %+v, %v; want not delivered", res, err)
+	}
+}
+
+func TestEmailChannelContext(t *testing.T) {
+	srv := newFakeSMTP(t, true)
+	ch := &EmailChannel{Addr: srv.ln.Addr().String(), From: "alarms@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ch.Deliver(ctx, &dst.Device{Destination: "nurse@example.com"}, &dst.Notification{NtID: "nt-1"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Deliver = %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deliver did not return when the context was done")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -15,7 +14,13 @@ import (
 )
 
 //ActionAdd will add a new action to the datastore database
-func ActionAdd(ctx context.Context, client *datastore.Client, ac *dst.Action) (*datastore.Key, error) {
+func ActionAdd(ctx context.Context, client *datastore.Client, ac *dst.Action) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "ActionAdd", dst.KindActions, "acID = "+ac.AcID)
+	defer func() { endSpan(span, noCount, err) }()
+	// validate the fields before storing
+	if err := ValidateAction(ctx, client, ac); err != nil {
+		return nil, err
+	}
 	// first check if there already exists this Action by acID:
 	actions, err := ActionGetByAcID(ctx, client, ac.AcID)
 	if err != nil {
@@ -23,7 +28,7 @@ func ActionAdd(ctx context.Context, client *datastore.Client, ac *dst.Action) (*
 	}
 	// if it has already the value, return key and error
 	if len(actions) > 0 {
-		return &datastore.Key{ID: actions[0].ID, Kind: dst.KindActions}, fmt.Errorf("acID allready exists. %d", actions[0].ID)
+		return &datastore.Key{ID: actions[0].ID, Kind: dst.KindActions, Namespace: TenantFromContext(ctx)}, fmt.Errorf("acID allready exists. %d", actions[0].ID)
 	}
 	// copy information into the datastore format
 	n := &dst.Action{
@@ -35,22 +40,23 @@ func ActionAdd(ctx context.Context, client *datastore.Client, ac *dst.Action) (*
 		RawRequest:  ac.RawRequest,
 	}
 	//do the insert into the database
-	key := datastore.IncompleteKey(dst.KindActions, nil)
+	key := newIncompleteKey(ctx, dst.KindActions, nil)
 	return client.Put(ctx, key, n)
 }
 
 // ActionGetByAcID will return the list of actions with the same acID
-func ActionGetByAcID(ctx context.Context, client *datastore.Client, acID string) ([]*dst.Action, error) {
-	log.Println("[ActionGetByAcID] will filter by cpID:", acID)
+func ActionGetByAcID(ctx context.Context, client *datastore.Client, acID string) (result []*dst.Action, err error) {
+	ctx, span := startSpan(ctx, "ActionGetByAcID", dst.KindActions, "acID = "+acID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var actions []*dst.Action
 	// Create a query to fetch all Actions filtered by acID
-	query := datastore.NewQuery(dst.KindActions).Filter("acID =", acID)
-	log.Println("[ActionGetByAcID] will perform query")
-	keys, err := client.GetAll(ctx, query, &actions)
+	query := newQuery(ctx, dst.KindActions).Filter("acID =", acID)
+	keys, err := getAll(ctx, client, query, &actions)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[ActionGetByAcID] Total keys returned", len(keys))
+	logQuery(ctx, "ActionGetByAcID", dst.KindActions, acID, len(keys), start)
 	// Set the ID field on each Action from the corresponding key.
 	for i, key := range keys {
 		actions[i].ID = key.ID
@@ -59,16 +65,18 @@ func ActionGetByAcID(ctx context.Context, client *datastore.Client, acID string)
 }
 
 // ActionsListAll returns all the actions in ascending order of creation time.
-func ActionsListAll(ctx context.Context, client *datastore.Client) ([]*dst.Action, error) {
-	log.Println("[ActionsListAll] Get all action records")
+func ActionsListAll(ctx context.Context, client *datastore.Client) (result []*dst.Action, err error) {
+	ctx, span := startSpan(ctx, "ActionsListAll", dst.KindActions, "")
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var actions []*dst.Action
 	// Create a query to fetch all Actions entities, ordered by "created".
-	query := datastore.NewQuery(dst.KindActions).Order("created")
-	keys, err := client.GetAll(ctx, query, &actions)
+	query := newQuery(ctx, dst.KindActions).Order("created")
+	keys, err := getAll(ctx, client, query, &actions)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[ActionsListAll] Total keys returned", len(keys))
+	logQuery(ctx, "ActionsListAll", dst.KindActions, "", len(keys), start)
 	// Set the id field on each Actions from the corresponding DataStore key.
 	for i, key := range keys {
 		actions[i].ID = key.ID
@@ -0,0 +1,163 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func init() {
+	// callpoints stored before CallpointAdd normalized the address are missed by the prefix queries
+	RegisterMigration(Migration{
+		Kind:        dst.KindCallpoints,
+		Version:     1,
+		Description: "normalize absAddress",
+		Up:          normalizeAddressProperty,
+	})
+}
+
+// AddressNode is a node of the callpoints address tree, such as a site, building, floor, room or bed
+type AddressNode struct {
+	Name       string
+	Path       string
+	Children   []*AddressNode
+	Callpoints []*dst.Callpoint
+}
+
+// NormalizeAddress returns the AbsAddress path without empty elements or surrounding slashes
+func NormalizeAddress(address string) string {
+	var parts []string
+	for _, p := range strings.Split(address, "/") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// normalizeAddressProperty normalizes the absAddress property of a stored callpoint
+func normalizeAddressProperty(props *datastore.PropertyList) error {
+	for i, p := range *props {
+		if p.Name != "absAddress" {
+			continue
+		}
+		address, ok := p.Value.(string)
+		if !ok {
+			return fmt.Errorf("absAddress is a %T, not a string", p.Value)
+		}
+		(*props)[i].Value = NormalizeAddress(address)
+	}
+	return nil
+}
+
+// AddressAncestors returns the paths from the root to the address itself.
+// "site/building/floor" returns "site", "site/building" and "site/building/floor".
+func AddressAncestors(address string) []string {
+	address = NormalizeAddress(address)
+	if address == "" {
+		return nil
+	}
+	parts := strings.Split(address, "/")
+	paths := make([]string, len(parts))
+	for i := range parts {
+		paths[i] = strings.Join(parts[:i+1], "/")
+	}
+	return paths
+}
+
+// AddressTarget returns the assignment cpID that targets a node of the address tree.
+// Devices assigned to it cover all the callpoints at or below that node.
+func AddressTarget(address string) string {
+	return AddressTargetPrefix + NormalizeAddress(address)
+}
+
+// CallpointsByAddressPrefix will return the callpoints at or below the address, ordered by address.
+// The addresses are stored normalized, callpoints stored before need the callpoints migration (see Migrate).
+func CallpointsByAddressPrefix(ctx context.Context, client *datastore.Client, prefix string) (result []*dst.Callpoint, err error) {
+	ctx, span := startSpan(ctx, "CallpointsByAddressPrefix", dst.KindCallpoints, "absAddress prefix "+prefix)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
+	prefix = NormalizeAddress(prefix)
+	var callpoints []*dst.Callpoint
+	// Create a query to fetch the callpoints with an address in the prefix range
+	query := newQuery(ctx, dst.KindCallpoints).
+		Filter("absAddress >=", prefix).
+		Filter("absAddress <", prefix+"\uffff").
+		Order("absAddress")
+	keys, err := getAll(ctx, client, query, &callpoints)
+	if err != nil {
+		return nil, err
+	}
+	logQuery(ctx, "CallpointsByAddressPrefix", dst.KindCallpoints, prefix, len(keys), start)
+	// Set the ID field on each Callpoint and keep the ones in the prefix subtree, not just starting with it
+	var below []*dst.Callpoint
+	for i, key := range keys {
+		callpoints[i].ID = key.ID
+		address := NormalizeAddress(callpoints[i].AbsAddress)
+		if prefix == "" || address == prefix || strings.HasPrefix(address, prefix+"/") {
+			below = append(below, callpoints[i])
+		}
+	}
+	return below, nil
+}
+
+// CallpointsTree returns the address tree of all the callpoints, with the callpoints at each node.
+// The root node has an empty name and holds the callpoints without address.
+func CallpointsTree(ctx context.Context, client *datastore.Client) (result *AddressNode, err error) {
+	ctx, span := startSpan(ctx, "CallpointsTree", dst.KindCallpoints, "")
+	defer func() { endSpan(span, noCount, err) }()
+	callpoints, err := CallpointsListAll(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	root := &AddressNode{}
+	nodes := map[string]*AddressNode{"": root}
+	for _, cp := range callpoints {
+		node := root
+		for _, path := range AddressAncestors(cp.AbsAddress) {
+			child, ok := nodes[path]
+			if !ok {
+				child = &AddressNode{Name: path[strings.LastIndex(path, "/")+1:], Path: path}
+				nodes[path] = child
+				node.Children = append(node.Children, child)
+			}
+			node = child
+		}
+		node.Callpoints = append(node.Callpoints, cp)
+	}
+	for _, n := range nodes {
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	}
+	return root, nil
+}
+
+// assignmentsByAddress will return the assignments to the address tree nodes at or above the callpoint,
+// with the cpID set to the callpoint
+func assignmentsByAddress(ctx context.Context, client *datastore.Client, cpID string) ([]*dst.Assignment, error) {
+	cps, err := CallpointGetByCpID(ctx, client, cpID)
+	if err != nil || len(cps) <= 0 {
+		return nil, err
+	}
+	var inherited []*dst.Assignment
+	for _, path := range AddressAncestors(cps[0].AbsAddress) {
+		var assignments []*dst.Assignment
+		query := newQuery(ctx, dst.KindAssignments).Filter("cpID =", AddressTarget(path))
+		keys, err := getAll(ctx, client, query, &assignments)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			assignments[i].ID = key.ID
+			assignments[i].CpID = cpID
+		}
+		inherited = append(inherited, assignments...)
+	}
+	logger().DebugContext(ctx, "inherited assignments", LogKeyOp, "assignmentsByAddress", LogKeyKind, dst.KindCallpoints, LogKeyBusinessID, cpID, LogKeyCount, len(inherited))
+	return inherited, nil
+}
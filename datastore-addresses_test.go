@@ -0,0 +1,31 @@
+package gcp
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestNormalizeAddressProperty(t *testing.T) {
+	props := datastore.PropertyList{
+		{Name: "cpID", Value: "cp-1"},
+		{Name: "absAddress", Value: " /site/ building//floor-2/ "},
+	}
+	if err := normalizeAddressProperty(&props); err != nil {
+		t.Fatal(err)
+	}
+	if got := props[1].Value; got != "site/building/floor-2" {
+		t.Fatalf("absAddress = %q, want site/building/floor-2", got)
+	}
+	if got := props[0].Value; got != "cp-1" {
+		t.Fatalf("cpID changed to %q", got)
+	}
+	// running it again changes nothing, as migrations must be idempotent
+	if err := normalizeAddressProperty(&props); err != nil || props[1].Value != "site/building/floor-2" {
+		t.Fatalf("second run = %q, %v", props[1].Value, err)
+	}
+	bad := datastore.PropertyList{{Name: "absAddress", Value: int64(12)}}
+	if err := normalizeAddressProperty(&bad); err == nil {
+		t.Fatal("absAddress of another type accepted")
+	}
+}
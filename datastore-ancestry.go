@@ -0,0 +1,143 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// ErrNoEntityGroups is returned by the helpers that need a notification stored in an entity group
+var ErrNoEntityGroups = errors.New("notification is not in an entity group")
+
+var entityGroups atomic.Bool
+
+// SetEntityGroups sets if new notifications are stored as children of their action key, and new
+// events as children of their notification key. With entity groups, reading the events of a
+// notification is a strongly consistent ancestor query and events can be added in transactions.
+// The key of each grouped notification is also stored by ntID (KindNotificationRefs), so its events
+// find their parent with a lookup.
+// Notifications stored before enabling it, or without a stored action, stay root entities together
+// with their events, and are still found by the queries. It should not be disabled once enabled.
+func SetEntityGroups(enabled bool) {
+	entityGroups.Store(enabled)
+}
+
+// EntityGroupsEnabled reports if entity groups are enabled
+func EntityGroupsEnabled() bool {
+	return entityGroups.Load()
+}
+
+// actionKey returns the key of the action, or nil if it does not exist
+func actionKey(ctx context.Context, client *datastore.Client, acID string) (*datastore.Key, error) {
+	keys, err := client.GetAll(ctx, newQuery(ctx, dst.KindActions).Filter("acID =", acID).KeysOnly(), nil)
+	if err != nil || len(keys) <= 0 {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// notificationRef is stored with the ntID as key name, so the key of a notification in the entity
+// group of its action is found with a lookup instead of an eventually consistent query
+type notificationRef struct {
+	Key *datastore.Key `datastore:"key,noindex"`
+}
+
+// notificationPutGrouped stores the notification in the entity group of its action, together with its
+// notificationRef, and returns its key
+func notificationPutGrouped(ctx context.Context, client *datastore.Client, key *datastore.Key, n *dst.Notification) (*datastore.Key, error) {
+	keys, err := client.AllocateIDs(ctx, []*datastore.Key{key})
+	if err != nil {
+		return nil, err
+	}
+	key = keys[0]
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if _, err := tx.Put(key, n); err != nil {
+			return err
+		}
+		_, err := tx.Put(newNameKey(ctx, KindNotificationRefs, n.NtID, nil), &notificationRef{Key: key})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// groupedNotificationKey returns the key of the notification when it is stored in the entity group
+// of its action, or nil otherwise
+func groupedNotificationKey(ctx context.Context, client *datastore.Client, ntID string) (*datastore.Key, error) {
+	if !EntityGroupsEnabled() {
+		return nil, nil
+	}
+	ref := &notificationRef{}
+	err := client.Get(ctx, newNameKey(ctx, KindNotificationRefs, ntID, nil), ref)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ref.Key, nil
+}
+
+// eventsQuery returns the query of the events of the notification, as an ancestor query when
+// its grouped key nk is given
+func eventsQuery(ctx context.Context, ntID string, nk *datastore.Key) *datastore.Query {
+	query := newQuery(ctx, dst.KindEvents).Filter("ntID =", ntID)
+	if nk != nil {
+		query = query.Ancestor(nk)
+	}
+	return query
+}
+
+// EventAddWithUpdate adds the event and updates its notification in a single transaction.
+// update is called with the stored notification and may change it; it is not saved if update fails.
+// It needs the notification stored in an entity group (see SetEntityGroups) and refuses events
+// for closed notifications with ErrNotificationClosed.
+func EventAddWithUpdate(ctx context.Context, client *datastore.Client, ev *dst.Event, update func(n *dst.Notification) error) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "EventAddWithUpdate", dst.KindEvents, "ntID = "+ev.NtID)
+	defer func() { endSpan(span, noCount, err) }()
+	if err = ValidateEvent(ev); err != nil {
+		return nil, err
+	}
+	nk, err := groupedNotificationKey(ctx, client, ev.NtID)
+	if err != nil {
+		return nil, err
+	}
+	if nk == nil {
+		return nil, fmt.Errorf("%w. ntID: %s", ErrNoEntityGroups, ev.NtID)
+	}
+	var pending *datastore.PendingKey
+	commit, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		n := &dst.Notification{}
+		if err := ignoreSchemaVersion(tx.Get(nk, n)); err != nil {
+			return err
+		}
+		ended := newQuery(ctx, dst.KindEvents).Ancestor(nk).Filter("evType =", EvTypeEnded).KeysOnly().Transaction(tx)
+		keys, err := client.GetAll(ctx, ended, nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return fmt.Errorf("%w. ntID: %s", ErrNotificationClosed, ev.NtID)
+		}
+		if err = update(n); err != nil {
+			return err
+		}
+		if _, err = tx.Put(nk, n); err != nil {
+			return err
+		}
+		pending, err = tx.Put(newIncompleteKey(ctx, dst.KindEvents, nk), newEvent(ev))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger().InfoContext(ctx, "event added", LogKeyOp, "EventAddWithUpdate", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, ev.NtID)
+	return commit.Key(pending), nil
+}
@@ -0,0 +1,77 @@
+package gcp
+
+import (
+	"errors"
+	"testing"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestEntityGroups(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	SetEntityGroups(true)
+	t.Cleanup(func() { SetEntityGroups(false) })
+
+	acKey, err := ActionAdd(SkipReferenceChecks(ctx), client, &dst.Action{AcID: "ac-1", CpID: "cp-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := addTestNotification(ctx, t, client)
+	// the key of the notification is found from its ntID alone, under its action
+	nk, err := groupedNotificationKey(ctx, client, n.NtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nk == nil || nk.ID != n.ID || nk.Parent == nil || !nk.Parent.Equal(acKey) {
+		t.Fatalf("notification key = %v, want ID %d under %v", nk, n.ID, acKey)
+	}
+	evKey, err := EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", Visibility: VisibilityAll, EvType: EvTypeDevices, EvSubType: EvSubTypeDelivered})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evKey.Parent == nil || !evKey.Parent.Equal(nk) {
+		t.Fatalf("event key = %v, want a child of %v", evKey, nk)
+	}
+	_, err = EventAddWithUpdate(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", Visibility: VisibilityAll, EvType: EvTypeDevices, EvSubType: EvSubTypeReply, EvDescription: "OK"},
+		func(n *dst.Notification) error {
+			n.Destination = "dv-1"
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := EventsGetByNtID(ctx, client, n.NtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("events = %d, want 2", len(events))
+	}
+	if err = NotificationClose(ctx, client, n.NtID, EvSubTypeAcknowledged); err != nil {
+		t.Fatal(err)
+	}
+	_, err = EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", Visibility: VisibilityAll, EvType: EvTypeDevices, EvSubType: EvSubTypeReply})
+	if !errors.Is(err, ErrNotificationClosed) {
+		t.Fatalf("EventAdd after close = %v, want ErrNotificationClosed", err)
+	}
+}
+
+func TestEntityGroupsRootNotification(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	// stored before entity groups were enabled
+	n := addTestNotification(ctx, t, client)
+	SetEntityGroups(true)
+	t.Cleanup(func() { SetEntityGroups(false) })
+
+	evKey, err := EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", Visibility: VisibilityAll, EvType: EvTypeDevices, EvSubType: EvSubTypeDelivered})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evKey.Parent != nil {
+		t.Fatalf("event of a root notification stored under %v", evKey.Parent)
+	}
+	_, err = EventAddWithUpdate(ctx, client, &dst.Event{NtID: n.NtID, Visibility: VisibilityAll, EvType: EvTypeDevices}, func(*dst.Notification) error { return nil })
+	if !errors.Is(err, ErrNoEntityGroups) {
+		t.Fatalf("EventAddWithUpdate on a root notification = %v, want ErrNoEntityGroups", err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -15,8 +14,13 @@ import (
 )
 
 //AssignmentAdd will add a new assignments to the datastore database
-func AssignmentAdd(ctx context.Context, client *datastore.Client, asgn *dst.Assignment) (*datastore.Key, error) {
-
+func AssignmentAdd(ctx context.Context, client *datastore.Client, asgn *dst.Assignment) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "AssignmentAdd", dst.KindAssignments, "asID = "+asgn.AsID)
+	defer func() { endSpan(span, noCount, err) }()
+	// validate the fields before storing
+	if err := ValidateAssignment(ctx, client, asgn); err != nil {
+		return nil, err
+	}
 	// first check if there already exists this Assignment by asID:
 	assignmnets, err := AssignmentGetByAsID(ctx, client, asgn.AsID)
 	if err != nil {
@@ -24,7 +28,12 @@ func AssignmentAdd(ctx context.Context, client *datastore.Client, asgn *dst.Assi
 	}
 	// if it has already the value, return key and error
 	if len(assignmnets) > 0 {
-		return &datastore.Key{ID: assignmnets[0].ID, Kind: dst.KindAssignments}, fmt.Errorf("asID allready exists. %d", assignmnets[0].ID)
+		return &datastore.Key{ID: assignmnets[0].ID, Kind: dst.KindAssignments, Namespace: TenantFromContext(ctx)}, fmt.Errorf("asID allready exists. %d", assignmnets[0].ID)
+	}
+	// fill in the default settings of the assignments
+	settings, err := DefaultAssignmentSettings(asgn)
+	if err != nil {
+		return nil, err
 	}
 	// copy information into the datastore format
 	n := &dst.Assignment{
@@ -35,25 +44,32 @@ func AssignmentAdd(ctx context.Context, client *datastore.Client, asgn *dst.Assi
 		CpID:        asgn.CpID,
 		DvID:        asgn.DvID,
 		Level:       asgn.Level,
-		Settings:    asgn.Settings,
+		Settings:    settings,
 		RawRequest:  asgn.RawRequest,
 	}
 	//do the insert into the database
-	key := datastore.IncompleteKey(dst.KindAssignments, nil)
-	return client.Put(ctx, key, n)
+	key := newIncompleteKey(ctx, dst.KindAssignments, nil)
+	key, err = client.Put(ctx, key, n)
+	if err != nil {
+		return nil, err
+	}
+	cacheInvalidate(ctx, dst.KindAssignments, "")
+	return key, nil
 }
 
 // AssignmentGetByAsID will return the list of assignments with the same asID
-func AssignmentGetByAsID(ctx context.Context, client *datastore.Client, asID string) ([]*dst.Assignment, error) {
-	log.Println("[AssignmentGetByAsID] will filter by asID:", asID)
+func AssignmentGetByAsID(ctx context.Context, client *datastore.Client, asID string) (result []*dst.Assignment, err error) {
+	ctx, span := startSpan(ctx, "AssignmentGetByAsID", dst.KindAssignments, "asID = "+asID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var assignments []*dst.Assignment
 	// Create a query to fetch all Assignments filtered by asID
-	query := datastore.NewQuery(dst.KindAssignments).Filter("asID =", asID)
-	keys, err := client.GetAll(ctx, query, &assignments)
+	query := newQuery(ctx, dst.KindAssignments).Filter("asID =", asID)
+	keys, err := getAll(ctx, client, query, &assignments)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[AssignmentGetByAsID] Total keys returned", len(keys))
+	logQuery(ctx, "AssignmentGetByAsID", dst.KindAssignments, asID, len(keys), start)
 	// Set the ID field on each Assignment from the corresponding key.
 	for i, key := range keys {
 		assignments[i].ID = key.ID
@@ -61,21 +77,43 @@ func AssignmentGetByAsID(ctx context.Context, client *datastore.Client, asID str
 	return assignments, nil
 }
 
-// AssignmentsByCpID will return the list of assignments and its information with the same cpID
-func AssignmentsByCpID(ctx context.Context, client *datastore.Client, cpID string) ([]*dst.Assignment, error) {
-	log.Println("[AssignmentsByCpID] will filter by cpID:", cpID)
+// AssignmentsByCpID will return the list of assignments and its information with the same cpID,
+// including the assignments inherited from the nodes of its address tree (see AddressTarget).
+// Assignments to a device group are expanded into one assignment per member device, and a device
+// reached by more than one assignment is returned once, with its lowest level.
+// The result comes from the cache if enabled (see SetCache).
+func AssignmentsByCpID(ctx context.Context, client *datastore.Client, cpID string) (result []*dst.Assignment, err error) {
+	ctx, span := startSpan(ctx, "AssignmentsByCpID", dst.KindAssignments, "cpID = "+cpID)
+	defer func() { endSpan(span, len(result), err) }()
+	return cached(ctx, dst.KindAssignments, cpID, func() ([]*dst.Assignment, error) {
+		return assignmentsByCpID(ctx, client, cpID)
+	})
+}
+
+// assignmentsByCpID queries the assignments of the callpoint, see AssignmentsByCpID
+func assignmentsByCpID(ctx context.Context, client *datastore.Client, cpID string) ([]*dst.Assignment, error) {
+	start := time.Now()
 	var assignments []*dst.Assignment
 	// Create a query to fetch all Actions entities, ordered by "created".
-	query := datastore.NewQuery(dst.KindAssignments).Filter("cpID =", cpID)
-	keys, err := client.GetAll(ctx, query, &assignments)
+	query := newQuery(ctx, dst.KindAssignments).Filter("cpID =", cpID)
+	keys, err := getAll(ctx, client, query, &assignments)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[AssignmentsByCpID] Total keys returned", len(keys))
+	logQuery(ctx, "AssignmentsByCpID", dst.KindAssignments, cpID, len(keys), start)
 	// Set the ID field on each assignments from the corresponding key.
 	for i, key := range keys {
 		assignments[i].ID = key.ID
 	}
+	inherited, err := assignmentsByAddress(ctx, client, cpID)
+	if err != nil {
+		return nil, err
+	}
+	assignments = append(assignments, inherited...)
+	assignments, err = expandGroupAssignments(ctx, client, assignments)
+	if err != nil {
+		return nil, err
+	}
 	// Get device and callpoint associated to each assignment
 	for i, a := range assignments {
 		// Load Callpoint information from database
@@ -107,6 +145,44 @@ func AssignmentsByCpID(ctx context.Context, client *datastore.Client, cpID strin
 	return assignments, nil
 }
 
+// expandGroupAssignments replaces the assignments to a group by one assignment per member device,
+// keeping a single assignment per device with the lowest level.
+func expandGroupAssignments(ctx context.Context, client *datastore.Client, assignments []*dst.Assignment) ([]*dst.Assignment, error) {
+	var expanded []*dst.Assignment
+	byDevice := make(map[string]*dst.Assignment)
+	add := func(a *dst.Assignment) {
+		if prev, ok := byDevice[a.DvID]; ok {
+			if a.Level < prev.Level {
+				*prev = *a
+			}
+			return
+		}
+		byDevice[a.DvID] = a
+		expanded = append(expanded, a)
+	}
+	for _, a := range assignments {
+		grID, ok := GroupTargetID(a.DvID)
+		if !ok {
+			add(a)
+			continue
+		}
+		groups, err := DeviceGroupGetByGrID(ctx, client, grID)
+		if err != nil {
+			return nil, err
+		}
+		if len(groups) <= 0 {
+			logger().WarnContext(ctx, "group not found", LogKeyOp, "expandGroupAssignments", LogKeyKind, KindDeviceGroups, LogKeyBusinessID, grID)
+			continue
+		}
+		for _, dvID := range groups[0].Members {
+			m := *a
+			m.DvID = dvID
+			add(&m)
+		}
+	}
+	return expanded, nil
+}
+
 // AssignmentsToJSON prints the assignments into JSON to the given writer.
 func AssignmentsToJSON(w io.Writer, asgs []*dst.Assignment) {
 	const line = `%s
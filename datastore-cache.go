@@ -0,0 +1,320 @@
+package gcp
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/google/uuid"
+
+	dst "github.com/xallcloud/api/datastore"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attributes of the cache invalidation messages
+const (
+	attrCacheTenant = "tenant"
+	attrCacheID     = "id"
+	attrCacheOrigin = "origin"
+	// attrCacheAlso has the kinds forgotten entirely with the kind of the message, comma separated
+	attrCacheAlso = "also"
+)
+
+// CacheOptions bounds the entries kept by the cache
+type CacheOptions struct {
+	// TTL is how long an entry is used before it is read again from the datastore
+	TTL time.Duration
+	// MaxEntries is the number of entries kept, the least recently used are evicted first. 0 is unbounded.
+	MaxEntries int
+}
+
+// CacheStats counts the lookups answered by the cache
+type CacheStats struct {
+	Hits          int
+	Misses        int
+	Evictions     int
+	Invalidations int
+	Entries       int
+	// ByKind has the hits and misses of each kind
+	ByKind map[string]CacheKindStats
+}
+
+// CacheKindStats counts the lookups of a kind
+type CacheKindStats struct {
+	Hits   int
+	Misses int
+}
+
+// Cache is a read-through cache of the callpoints, devices and assignments lookups
+// (CallpointGetByCpID, DeviceGetByDvID and AssignmentsByCpID). It is enabled with SetCache.
+// Entries are forgotten by the Add, Update and Delete helpers of this package, and by the
+// other instances when invalidation is shared with EnableInvalidation.
+type Cache struct {
+	opts   CacheOptions
+	clock  Clock
+	origin string
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	// gens counts the invalidations of each kind in each tenant, with an empty id, so a load that
+	// raced with an invalidation of its kind is not cached. It has one entry per kind and tenant.
+	gens  map[cacheKey]uint64
+	stats CacheStats
+	topic *pubsub.Topic
+}
+
+// cacheKey identifies the result of a lookup
+type cacheKey struct {
+	kind   string
+	tenant string
+	id     string
+}
+
+// cacheEntry is a cached lookup result
+type cacheEntry struct {
+	key     cacheKey
+	value   interface{}
+	expires time.Time
+}
+
+var cache atomic.Pointer[Cache]
+
+// NewCache returns an empty cache
+func NewCache(opts CacheOptions) *Cache {
+	return &Cache{
+		opts:    opts,
+		clock:   systemClock{},
+		origin:  uuid.New().String(),
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+		gens:    make(map[cacheKey]uint64),
+		stats:   CacheStats{ByKind: make(map[string]CacheKindStats)},
+	}
+}
+
+// SetCache sets the cache used by the lookups, nil disables caching
+func SetCache(c *Cache) {
+	cache.Store(c)
+}
+
+// SetClock replaces the clock used for the TTL
+func (c *Cache) SetClock(clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+}
+
+// get returns the cached value of the lookup, if not expired. On a miss, it returns the generation
+// of the lookup to give to put once loaded.
+func (c *Cache) get(ctx context.Context, kind, id string) (value interface{}, gen uint64, ok bool) {
+	defer func() { metrics().CacheLookup(kind, ok) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ks := c.stats.ByKind[kind]
+	defer func() { c.stats.ByKind[kind] = ks }()
+	key := cacheKey{kind: kind, tenant: TenantFromContext(ctx), id: id}
+	el, found := c.entries[key]
+	if found && c.clock.Now().Before(el.Value.(*cacheEntry).expires) {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		ks.Hits++
+		return el.Value.(*cacheEntry).value, 0, true
+	}
+	if found {
+		c.removeElement(el)
+	}
+	c.stats.Misses++
+	ks.Misses++
+	return nil, c.generation(key), false
+}
+
+// put stores the value of the lookup, unless it was invalidated since get returned gen, evicting
+// the least recently used entries above MaxEntries
+func (c *Cache) put(ctx context.Context, kind, id string, value interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{kind: kind, tenant: TenantFromContext(ctx), id: id}
+	if c.generation(key) != gen {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, expires: c.clock.Now().Add(c.opts.TTL)})
+	for c.opts.MaxEntries > 0 && c.lru.Len() > c.opts.MaxEntries {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// generation returns the number of invalidations of the kind of the lookup in its tenant.
+// Must be called with the lock held
+func (c *Cache) generation(key cacheKey) uint64 {
+	return c.gens[cacheKey{kind: key.kind, tenant: key.tenant}]
+}
+
+// removeElement removes the entry. Must be called with the lock held
+func (c *Cache) removeElement(el *list.Element) {
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	c.lru.Remove(el)
+}
+
+// Invalidate forgets the cached lookup of the kind and id in the tenant of the context, or all the
+// lookups of the kind when id is empty. With EnableInvalidation, the other instances forget it too.
+func (c *Cache) Invalidate(ctx context.Context, kind, id string) {
+	c.invalidate(ctx, kind, id, nil)
+}
+
+// invalidate forgets the lookup of the kind and id, and all the lookups of the kinds in also,
+// sharing them with the other instances in a single message published in the background,
+// so the write that invalidated does not wait for pubsub
+func (c *Cache) invalidate(ctx context.Context, kind, id string, also []string) {
+	tenant := TenantFromContext(ctx)
+	c.forget(kind, tenant, id)
+	for _, k := range also {
+		c.forget(k, tenant, "")
+	}
+	c.mu.Lock()
+	topic := c.topic
+	c.mu.Unlock()
+	if topic == nil {
+		return
+	}
+	attrs := map[string]string{
+		AttrKind:        kind,
+		attrCacheTenant: tenant,
+		attrCacheID:     id,
+		attrCacheOrigin: c.origin,
+	}
+	if len(also) > 0 {
+		attrs[attrCacheAlso] = strings.Join(also, ",")
+	}
+	InjectTraceContext(ctx, attrs)
+	// the message outlives the request that made the write
+	ctx = context.WithoutCancel(ctx)
+	res := topic.Publish(ctx, &pubsub.Message{Attributes: attrs})
+	go func() {
+		_, err := res.Get(ctx)
+		metrics().Published(topic.ID(), kind, outcome(err))
+		if err != nil {
+			// the entries of the other instances still expire after the TTL
+			logger().WarnContext(ctx, "failed to publish cache invalidation", LogKeyOp, "Invalidate", LogKeyKind, kind, LogKeyBusinessID, id, LogKeyError, err)
+		}
+	}()
+}
+
+// forget removes the matching entries, and stops the loads of the kind in progress from caching them
+func (c *Cache) forget(kind, tenant, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if key.kind == kind && key.tenant == tenant && (id == "" || key.id == id) {
+			c.removeElement(el)
+		}
+	}
+	c.gens[cacheKey{kind: kind, tenant: tenant}]++
+	c.stats.Invalidations++
+}
+
+// EnableInvalidation creates the topic and the subscription if needed, publishes the invalidations
+// of this cache to the topic, and forgets the entries invalidated by the other instances until ctx is done.
+// Each instance needs its own subscription name, so every instance receives all the invalidations.
+func (c *Cache) EnableInvalidation(ctx context.Context, client *pubsub.Client, topic, subName string) error {
+	t, err := CreateTopicContext(ctx, topic, client)
+	if err != nil {
+		return err
+	}
+	sub, err := CreateSubContext(ctx, client, subName, t)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.topic = t
+	c.mu.Unlock()
+	go func() {
+		err := sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+			if m.Attributes[attrCacheOrigin] != c.origin {
+				_, span := startSpan(ExtractTraceContext(ctx, m.Attributes), "cache invalidation", m.Attributes[AttrKind], m.Attributes[attrCacheID],
+					trace.WithSpanKind(trace.SpanKindConsumer))
+				c.forget(m.Attributes[AttrKind], m.Attributes[attrCacheTenant], m.Attributes[attrCacheID])
+				if also := m.Attributes[attrCacheAlso]; also != "" {
+					for _, kind := range strings.Split(also, ",") {
+						c.forget(kind, m.Attributes[attrCacheTenant], "")
+					}
+				}
+				endSpan(span, noCount, nil)
+			}
+			m.Ack()
+			metrics().Acked(subName, m.Attributes[AttrKind], OutcomeOK)
+		})
+		if err != nil {
+			logger().WarnContext(ctx, "stopped receiving cache invalidations", LogKeyOp, "EnableInvalidation", "subscription", subName, LogKeyError, err)
+		}
+	}()
+	logger().InfoContext(ctx, "cache invalidation enabled", LogKeyOp, "EnableInvalidation", "topic", topic, "subscription", subName)
+	return nil
+}
+
+// Stats returns a copy of the cache statistics
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.ByKind = make(map[string]CacheKindStats, len(c.stats.ByKind))
+	for kind, ks := range c.stats.ByKind {
+		stats.ByKind[kind] = ks
+	}
+	return stats
+}
+
+// cached returns the result of the lookup from the cache, or loads and caches it.
+// Empty results are not cached, so an entity added by another instance is found at once.
+// The entities are copied, so callers can change them without changing the cache. A result loaded
+// while the lookup is invalidated is returned but not cached, as it may be older than the write.
+func cached[T any](ctx context.Context, kind, id string, load func() ([]*T, error)) ([]*T, error) {
+	c := cache.Load()
+	if c == nil {
+		return load()
+	}
+	v, gen, ok := c.get(ctx, kind, id)
+	if ok {
+		return copyEntities(v.([]*T)), nil
+	}
+	values, err := load()
+	if err != nil || len(values) <= 0 {
+		return values, err
+	}
+	c.put(ctx, kind, id, copyEntities(values), gen)
+	return values, nil
+}
+
+// copyEntities returns a copy of each entity
+func copyEntities[T any](values []*T) []*T {
+	copies := make([]*T, len(values))
+	for i, v := range values {
+		c := *v
+		copies[i] = &c
+	}
+	return copies
+}
+
+// cacheInvalidate forgets the cached lookups of the kind after a write, id empty for all of the kind.
+// Cached assignments include callpoint, device and group data, so they are always forgotten,
+// in the same invalidation message.
+func cacheInvalidate(ctx context.Context, kind, id string) {
+	c := cache.Load()
+	if c == nil {
+		return
+	}
+	if kind == dst.KindAssignments {
+		c.invalidate(ctx, kind, id, nil)
+		return
+	}
+	c.invalidate(ctx, kind, id, []string{dst.KindAssignments})
+}
@@ -0,0 +1,209 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// newTestCache enables a cache with a fake clock for the test
+func newTestCache(t *testing.T, opts CacheOptions) (*Cache, *fakeClock) {
+	t.Helper()
+	c := NewCache(opts)
+	clock := newFakeClock()
+	c.SetClock(clock)
+	SetCache(c)
+	t.Cleanup(func() { SetCache(nil) })
+	return c, clock
+}
+
+// countingLoad returns a load of the device that counts its calls, and runs during if set
+func countingLoad(dvID string, loads *int, during func()) func() ([]*dst.Device, error) {
+	return func() ([]*dst.Device, error) {
+		*loads++
+		if during != nil {
+			during()
+		}
+		return []*dst.Device{{DvID: dvID}}, nil
+	}
+}
+
+func TestCacheTTLAndEviction(t *testing.T) {
+	c, clock := newTestCache(t, CacheOptions{TTL: time.Minute, MaxEntries: 2})
+	ctx := context.Background()
+	loads := 0
+	for i := 0; i < 2; i++ {
+		if _, err := cached(ctx, dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("loads = %d, want 1 before the TTL", loads)
+	}
+	clock.Advance(2 * time.Minute)
+	cached(ctx, dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil))
+	if loads != 2 {
+		t.Fatalf("loads = %d, want 2 after the TTL", loads)
+	}
+
+	cached(ctx, dst.KindDevices, "dv-2", countingLoad("dv-2", &loads, nil))
+	cached(ctx, dst.KindDevices, "dv-3", countingLoad("dv-3", &loads, nil))
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("stats = %+v, want 2 entries and 1 eviction", stats)
+	}
+	if ks := stats.ByKind[dst.KindDevices]; ks.Hits != 1 || ks.Misses != 4 {
+		t.Fatalf("%s stats = %+v, want 1 hit and 4 misses", dst.KindDevices, ks)
+	}
+}
+
+func TestCacheTenants(t *testing.T) {
+	newTestCache(t, CacheOptions{TTL: time.Minute})
+	loads := 0
+	cached(WithTenant(context.Background(), "a"), dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil))
+	cached(WithTenant(context.Background(), "b"), dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil))
+	if loads != 2 {
+		t.Fatalf("loads = %d, want one per tenant", loads)
+	}
+}
+
+func TestCacheInvalidationDuringLoad(t *testing.T) {
+	c, _ := newTestCache(t, CacheOptions{TTL: time.Minute})
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		id   string
+	}{
+		{"same id", "dv-1"},
+		{"whole kind", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c.Invalidate(ctx, dst.KindDevices, "")
+			loads := 0
+			// a write of another instance lands between the read and the put of the loaded value
+			write := func() { c.Invalidate(ctx, dst.KindDevices, tc.id) }
+			if _, err := cached(ctx, dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, write)); err != nil {
+				t.Fatal(err)
+			}
+			cached(ctx, dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil))
+			if loads != 2 {
+				t.Fatalf("loads = %d, want the value loaded during the invalidation not cached", loads)
+			}
+			cached(ctx, dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil))
+			if loads != 2 {
+				t.Fatalf("loads = %d, want the next load cached", loads)
+			}
+		})
+	}
+}
+
+func TestCacheGenerationsBounded(t *testing.T) {
+	c, _ := newTestCache(t, CacheOptions{TTL: time.Minute})
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		c.Invalidate(ctx, dst.KindDevices, fmt.Sprintf("dv-%d", i))
+		c.Invalidate(WithTenant(ctx, "other"), dst.KindDevices, fmt.Sprintf("dv-%d", i))
+	}
+	if len(c.gens) != 2 {
+		t.Fatalf("generations = %d, want one per kind and tenant", len(c.gens))
+	}
+}
+
+func TestCacheInvalidateAssignments(t *testing.T) {
+	c, _ := newTestCache(t, CacheOptions{TTL: time.Minute})
+	ctx := context.Background()
+	loads := 0
+	cached(ctx, dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil))
+	cached(ctx, dst.KindAssignments, "cp-1", func() ([]*dst.Assignment, error) {
+		return []*dst.Assignment{{CpID: "cp-1", DvID: "dv-1"}}, nil
+	})
+	cacheInvalidate(ctx, dst.KindDevices, "dv-1")
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Fatalf("stats = %+v, want the device and the assignments forgotten", stats)
+	}
+}
+
+// cacheMetrics records the cache lookups
+type cacheMetrics struct {
+	nopMetrics
+	mu      sync.Mutex
+	lookups map[bool]int
+}
+
+func (m *cacheMetrics) CacheLookup(kind string, hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookups[hit]++
+}
+
+func TestCacheMetrics(t *testing.T) {
+	m := &cacheMetrics{lookups: make(map[bool]int)}
+	SetMetrics(m)
+	t.Cleanup(func() { SetMetrics(nil) })
+	newTestCache(t, CacheOptions{TTL: time.Minute})
+	loads := 0
+	for i := 0; i < 3; i++ {
+		cached(context.Background(), dst.KindDevices, "dv-1", countingLoad("dv-1", &loads, nil))
+	}
+	if m.lookups[true] != 2 || m.lookups[false] != 1 {
+		t.Fatalf("lookups = %v, want 2 hits and 1 miss", m.lookups)
+	}
+}
+
+// waitForEntries waits until the cache has the number of entries, as invalidations arrive in the background
+func waitForEntries(t *testing.T, c *Cache, want int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for c.Stats().Entries != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache entries = %d, want %d", c.Stats().Entries, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCachePubSubInvalidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ps := newTestPubSub(t)
+	// two instances, each with its own subscription
+	a, b := NewCache(CacheOptions{TTL: time.Hour}), NewCache(CacheOptions{TTL: time.Hour})
+	if err := a.EnableInvalidation(ctx, ps.Client, "cache", "cache-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EnableInvalidation(ctx, ps.Client, "cache", "cache-b"); err != nil {
+		t.Fatal(err)
+	}
+	tenant := WithTenant(ctx, "a")
+	for _, k := range []struct {
+		ctx      context.Context
+		kind, id string
+	}{
+		{tenant, dst.KindDevices, "dv-1"},
+		{tenant, dst.KindDevices, "dv-2"},
+		{tenant, dst.KindAssignments, "cp-1"},
+		// the same device in another tenant is not invalidated
+		{WithTenant(ctx, "b"), dst.KindDevices, "dv-1"},
+	} {
+		_, gen, _ := b.get(k.ctx, k.kind, k.id)
+		b.put(k.ctx, k.kind, k.id, []*dst.Device{{}}, gen)
+	}
+
+	// a device written by instance a is forgotten by b, with the assignments that include it
+	a.invalidate(tenant, dst.KindDevices, "dv-1", []string{dst.KindAssignments})
+	waitForEntries(t, b, 2)
+	if _, _, ok := b.get(tenant, dst.KindDevices, "dv-2"); !ok {
+		t.Fatal("dv-2 forgotten, want only dv-1 and the assignments")
+	}
+	if _, _, ok := b.get(WithTenant(ctx, "b"), dst.KindDevices, "dv-1"); !ok {
+		t.Fatal("dv-1 of the other tenant forgotten")
+	}
+	// an instance ignores its own invalidations
+	if got := a.Stats().Invalidations; got != 2 {
+		t.Fatalf("invalidations of instance a = %d, want 2 from its own write", got)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -15,21 +15,27 @@ import (
 )
 
 //CallpointAdd will add a new callpoint to the datastore database
-func CallpointAdd(ctx context.Context, client *datastore.Client, cp *dst.Callpoint) (*datastore.Key, error) {
-	// first check if there already exists this Callpoint ID:
-	callpoints, err := CallpointGetByCpID(ctx, client, cp.CpID)
+func CallpointAdd(ctx context.Context, client *datastore.Client, cp *dst.Callpoint) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "CallpointAdd", dst.KindCallpoints, "cpID = "+cp.CpID)
+	defer func() { endSpan(span, noCount, err) }()
+	// validate the fields before storing
+	if err := ValidateCallpoint(cp); err != nil {
+		return nil, err
+	}
+	// first check if there already exists this Callpoint ID, skipping the cache:
+	callpoints, err := callpointGetByCpID(ctx, client, cp.CpID)
 	if err != nil {
 		return nil, err
 	}
 	// if it has already the value, return key and error
 	if len(callpoints) > 0 {
-		return &datastore.Key{ID: callpoints[0].ID, Kind: dst.KindCallpoints}, fmt.Errorf("cpID allready exists. %d", callpoints[0].ID)
+		return &datastore.Key{ID: callpoints[0].ID, Kind: dst.KindCallpoints, Namespace: TenantFromContext(ctx)}, fmt.Errorf("cpID allready exists. %d", callpoints[0].ID)
 	}
 	// copy information into the datastore format
 	n := &dst.Callpoint{
 		CpID:        cp.CpID,
 		Created:     time.Now(),
-		AbsAddress:  cp.AbsAddress,
+		AbsAddress:  NormalizeAddress(cp.AbsAddress),
 		Label:       cp.Label,
 		Description: cp.Description,
 		Type:        cp.Type,
@@ -38,22 +44,35 @@ func CallpointAdd(ctx context.Context, client *datastore.Client, cp *dst.Callpoi
 		RawRequest:  cp.RawRequest,
 	}
 	//do the insert into the database
-	key := datastore.IncompleteKey(dst.KindCallpoints, nil)
-	return client.Put(ctx, key, n)
+	key := newIncompleteKey(ctx, dst.KindCallpoints, nil)
+	key, err = client.Put(ctx, key, n)
+	if err != nil {
+		return nil, err
+	}
+	cacheInvalidate(ctx, dst.KindCallpoints, cp.CpID)
+	return key, nil
+}
+
+// CallpointGetByCpID will return the list of callpoints with the same cpID, from the cache if enabled (see SetCache)
+func CallpointGetByCpID(ctx context.Context, client *datastore.Client, cpID string) (result []*dst.Callpoint, err error) {
+	ctx, span := startSpan(ctx, "CallpointGetByCpID", dst.KindCallpoints, "cpID = "+cpID)
+	defer func() { endSpan(span, len(result), err) }()
+	return cached(ctx, dst.KindCallpoints, cpID, func() ([]*dst.Callpoint, error) {
+		return callpointGetByCpID(ctx, client, cpID)
+	})
 }
 
-// CallpointGetByCpID will return the list of callpoints with the same cpID
-func CallpointGetByCpID(ctx context.Context, client *datastore.Client, cpID string) ([]*dst.Callpoint, error) {
-	log.Println("[CallpointGetByCpID] will filter by cpID:", cpID)
+// callpointGetByCpID queries the callpoints with the same cpID
+func callpointGetByCpID(ctx context.Context, client *datastore.Client, cpID string) ([]*dst.Callpoint, error) {
+	start := time.Now()
 	var callpoints []*dst.Callpoint
 	// Create a query to fetch all Callpoints filtered by cpID
-	query := datastore.NewQuery(dst.KindCallpoints).Filter("cpID =", cpID)
-	log.Println("[CallpointGetByCpID] will perform query")
-	keys, err := client.GetAll(ctx, query, &callpoints)
+	query := newQuery(ctx, dst.KindCallpoints).Filter("cpID =", cpID)
+	keys, err := getAll(ctx, client, query, &callpoints)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[CallpointGetByCpID] Total keys returned", len(keys))
+	logQuery(ctx, "CallpointGetByCpID", dst.KindCallpoints, cpID, len(keys), start)
 	// Set the ID field on each Callpoint from the corresponding key.
 	for i, key := range keys {
 		callpoints[i].ID = key.ID
@@ -62,16 +81,18 @@ func CallpointGetByCpID(ctx context.Context, client *datastore.Client, cpID stri
 }
 
 // CallpointsListAll returns all callpoints in ascending order of creation time.
-func CallpointsListAll(ctx context.Context, client *datastore.Client) ([]*dst.Callpoint, error) {
-	log.Println("[CallpointsListAll] Get all action records")
+func CallpointsListAll(ctx context.Context, client *datastore.Client) (result []*dst.Callpoint, err error) {
+	ctx, span := startSpan(ctx, "CallpointsListAll", dst.KindCallpoints, "")
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var callpoints []*dst.Callpoint
 	// Create a query to fetch all callpoints entities, ordered by "created".
-	query := datastore.NewQuery(dst.KindCallpoints).Order("created")
-	keys, err := client.GetAll(ctx, query, &callpoints)
+	query := newQuery(ctx, dst.KindCallpoints).Order("created")
+	keys, err := getAll(ctx, client, query, &callpoints)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[CallpointsListAll] Total keys returned", len(keys))
+	logQuery(ctx, "CallpointsListAll", dst.KindCallpoints, "", len(keys), start)
 	// Set the id field on each Callpoint from the corresponding DataStore key.
 	for i, key := range keys {
 		callpoints[i].ID = key.ID
@@ -80,8 +101,14 @@ func CallpointsListAll(ctx context.Context, client *datastore.Client) ([]*dst.Ca
 }
 
 // CallpointDelete will delete a callpoint from the datastore
-func CallpointDelete(ctx context.Context, client *datastore.Client, cpKeyID int64) error {
-	return client.Delete(ctx, datastore.IDKey(dst.KindCallpoints, cpKeyID, nil))
+func CallpointDelete(ctx context.Context, client *datastore.Client, cpKeyID int64) (err error) {
+	ctx, span := startSpan(ctx, "CallpointDelete", dst.KindCallpoints, "__key__ = "+strconv.FormatInt(cpKeyID, 10))
+	defer func() { endSpan(span, noCount, err) }()
+	if err := client.Delete(ctx, newIDKey(ctx, dst.KindCallpoints, cpKeyID, nil)); err != nil {
+		return err
+	}
+	cacheInvalidate(ctx, dst.KindCallpoints, "")
+	return nil
 }
 
 // CallpointsToJSON prints the callpoints into JSON to the given writer.
@@ -43,3 +43,60 @@ const EvSubTypeTimeout = "timeout"
 
 // EvSubTypeReply that the device is being reached
 const EvSubTypeReply = "reply"
+
+//////////////////////////////////////////////////////////
+// devices: Category flags
+//////////////////////////////////////////////////////////
+
+// DvCategoryWebhook is a device reached with an HTTP POST to its destination URL
+const DvCategoryWebhook = "webhook"
+
+// DvCategoryEmail is a device reached with an email to its destination address
+const DvCategoryEmail = "email"
+
+//////////////////////////////////////////////////////////
+// events: Ended reasons, set as the subtype of EvTypeEnded
+//////////////////////////////////////////////////////////
+
+// EvSubTypeAcknowledged indicates that a device replied to the notification
+const EvSubTypeAcknowledged = "acknowledged"
+
+// EvSubTypeAllFailed indicates that no device could be reached
+const EvSubTypeAllFailed = "allfailed"
+
+// EvSubTypeCancelled indicates that the notification was cancelled
+const EvSubTypeCancelled = "cancelled"
+
+// EvSubTypeExpired indicates that the notification passed its maximum lifetime
+const EvSubTypeExpired = "expired"
+
+// EvSubTypeRetry indicates that the notification is a new trigger of an action
+const EvSubTypeRetry = "retry"
+
+// EvSubTypeSuppressed indicates that actions were coalesced into an open notification
+const EvSubTypeSuppressed = "suppressed"
+
+//////////////////////////////////////////////////////////
+// kinds stored by this package
+//////////////////////////////////////////////////////////
+
+// KindDeviceSchedules is the kind of the on-duty schedules of the devices
+const KindDeviceSchedules = "DeviceSchedules"
+
+// KindDeviceGroups is the kind of the groups of devices
+const KindDeviceGroups = "DeviceGroups"
+
+// GroupTargetPrefix is the prefix of an assignment dvID that targets a device group instead of a device
+const GroupTargetPrefix = "group:"
+
+// AddressTargetPrefix is the prefix of an assignment cpID that targets a node of the callpoints address tree
+const AddressTargetPrefix = "address:"
+
+// KindSchemaMigrations is the kind of the schema version and migration progress of each kind
+const KindSchemaMigrations = "SchemaMigrations"
+
+// KindNotificationRefs is the kind of the keys of the notifications stored in an entity group, by ntID
+const KindNotificationRefs = "NotificationRefs"
+
+// KindNotificationRetries is the kind of the retry counters of the notifications dispatched again, by ntID
+const KindNotificationRetries = "NotificationRetries"
@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -15,15 +15,26 @@ import (
 )
 
 //DeviceAdd will add a new device to the datastore database
-func DeviceAdd(ctx context.Context, client *datastore.Client, dv *dst.Device) (*datastore.Key, error) {
-	// first check if there already exists this Device by dvID:
-	devices, err := DeviceGetByDvID(ctx, client, dv.DvID)
+func DeviceAdd(ctx context.Context, client *datastore.Client, dv *dst.Device) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "DeviceAdd", dst.KindDevices, "dvID = "+dv.DvID)
+	defer func() { endSpan(span, noCount, err) }()
+	// validate the fields before storing
+	if err := ValidateDevice(dv); err != nil {
+		return nil, err
+	}
+	// first check if there already exists this Device by dvID, skipping the cache:
+	devices, err := deviceGetByDvID(ctx, client, dv.DvID)
 	if err != nil {
 		return nil, err
 	}
 	// if it has already the value, return key and error
 	if len(devices) > 0 {
-		return &datastore.Key{ID: devices[0].ID, Kind: dst.KindCallpoints}, fmt.Errorf("dvID allready exists. %d", devices[0].ID)
+		return &datastore.Key{ID: devices[0].ID, Kind: dst.KindDevices, Namespace: TenantFromContext(ctx)}, fmt.Errorf("dvID allready exists. %d", devices[0].ID)
+	}
+	// fill in the default settings of the device type
+	settings, err := DefaultDeviceSettings(dv)
+	if err != nil {
+		return nil, err
 	}
 	// copy information into the datastore format
 	n := &dst.Device{
@@ -37,27 +48,83 @@ func DeviceAdd(ctx context.Context, client *datastore.Client, dv *dst.Device) (*
 		IsTwoWay:    dv.IsTwoWay,
 		Category:    dv.Category,
 		Destination: dv.Destination,
-		Settings:    dv.Settings,
+		Settings:    settings,
 		RawRequest:  dv.RawRequest,
 	}
 	//do the insert into the database
-	key := datastore.IncompleteKey(dst.KindDevices, nil)
-	return client.Put(ctx, key, n)
+	key := newIncompleteKey(ctx, dst.KindDevices, nil)
+	key, err = client.Put(ctx, key, n)
+	if err != nil {
+		return nil, err
+	}
+	cacheInvalidate(ctx, dst.KindDevices, dv.DvID)
+	return key, nil
 }
 
-// DeviceGetByDvID will return the list of devices with the same dvID
-func DeviceGetByDvID(ctx context.Context, client *datastore.Client, dvID string) ([]*dst.Device, error) {
-	log.Println("[DeviceGetByDvID] will filter by cpID:", dvID)
+//DeviceUpdate will update an existing device, identified by its ID, in the datastore database
+func DeviceUpdate(ctx context.Context, client *datastore.Client, dv *dst.Device) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "DeviceUpdate", dst.KindDevices, "dvID = "+dv.DvID)
+	defer func() { endSpan(span, noCount, err) }()
+	// validate the fields before storing
+	if err := ValidateDevice(dv); err != nil {
+		return nil, err
+	}
+	key := newIDKey(ctx, dst.KindDevices, dv.ID, nil)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		n := &dst.Device{}
+		if err := ignoreSchemaVersion(tx.Get(key, n)); err != nil {
+			return err
+		}
+		if n.DvID != dv.DvID {
+			return fmt.Errorf("dvID cannot be changed. %s", n.DvID)
+		}
+		// fill in the default settings of the device type
+		settings, err := DefaultDeviceSettings(dv)
+		if err != nil {
+			return err
+		}
+		n.Changed = time.Now()
+		n.Label = dv.Label
+		n.Description = dv.Description
+		n.Type = dv.Type
+		n.Priority = dv.Priority
+		n.Icon = dv.Icon
+		n.IsTwoWay = dv.IsTwoWay
+		n.Category = dv.Category
+		n.Destination = dv.Destination
+		n.Settings = settings
+		n.RawRequest = dv.RawRequest
+		_, err = tx.Put(key, n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cacheInvalidate(ctx, dst.KindDevices, dv.DvID)
+	return key, nil
+}
+
+// DeviceGetByDvID will return the list of devices with the same dvID, from the cache if enabled (see SetCache)
+func DeviceGetByDvID(ctx context.Context, client *datastore.Client, dvID string) (result []*dst.Device, err error) {
+	ctx, span := startSpan(ctx, "DeviceGetByDvID", dst.KindDevices, "dvID = "+dvID)
+	defer func() { endSpan(span, len(result), err) }()
+	return cached(ctx, dst.KindDevices, dvID, func() ([]*dst.Device, error) {
+		return deviceGetByDvID(ctx, client, dvID)
+	})
+}
+
+// deviceGetByDvID queries the devices with the same dvID
+func deviceGetByDvID(ctx context.Context, client *datastore.Client, dvID string) ([]*dst.Device, error) {
+	start := time.Now()
 	var devices []*dst.Device
 	// Create a query to fetch all Devices filtered by dvID
-	query := datastore.NewQuery(dst.KindDevices).Filter("dvID =", dvID)
-	log.Println("[DeviceGetByDvID] will perform query")
-	keys, err := client.GetAll(ctx, query, &devices)
+	query := newQuery(ctx, dst.KindDevices).Filter("dvID =", dvID)
+	keys, err := getAll(ctx, client, query, &devices)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[DeviceGetByDvID] Total keys returned", len(keys))
-	// Set the ID field on each Callpoint from the corresponding key.
+	logQuery(ctx, "DeviceGetByDvID", dst.KindDevices, dvID, len(keys), start)
+	// Set the ID field on each Device from the corresponding key.
 	for i, key := range keys {
 		devices[i].ID = key.ID
 	}
@@ -65,16 +132,18 @@ func DeviceGetByDvID(ctx context.Context, client *datastore.Client, dvID string)
 }
 
 // DevicesListAll returns all the devices in ascending order of creation time.
-func DevicesListAll(ctx context.Context, client *datastore.Client) ([]*dst.Device, error) {
-	log.Println("[DevicesListAll] Get all devices records")
+func DevicesListAll(ctx context.Context, client *datastore.Client) (result []*dst.Device, err error) {
+	ctx, span := startSpan(ctx, "DevicesListAll", dst.KindDevices, "")
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var devices []*dst.Device
 	// Create a query to fetch all Devices entities, ordered by "created".
-	query := datastore.NewQuery(dst.KindDevices).Order("created")
-	keys, err := client.GetAll(ctx, query, &devices)
+	query := newQuery(ctx, dst.KindDevices).Order("created")
+	keys, err := getAll(ctx, client, query, &devices)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[DevicesListAll] Total keys returned", len(keys))
+	logQuery(ctx, "DevicesListAll", dst.KindDevices, "", len(keys), start)
 	// Set the id field on each Devices from the corresponding DataStore key.
 	for i, key := range keys {
 		devices[i].ID = key.ID
@@ -83,8 +152,14 @@ func DevicesListAll(ctx context.Context, client *datastore.Client) ([]*dst.Devic
 }
 
 // DeviceDelete will delete a device from the datastore
-func DeviceDelete(ctx context.Context, client *datastore.Client, dvKeyID int64) error {
-	return client.Delete(ctx, datastore.IDKey(dst.KindDevices, dvKeyID, nil))
+func DeviceDelete(ctx context.Context, client *datastore.Client, dvKeyID int64) (err error) {
+	ctx, span := startSpan(ctx, "DeviceDelete", dst.KindDevices, "__key__ = "+strconv.FormatInt(dvKeyID, 10))
+	defer func() { endSpan(span, noCount, err) }()
+	if err := client.Delete(ctx, newIDKey(ctx, dst.KindDevices, dvKeyID, nil)); err != nil {
+		return err
+	}
+	cacheInvalidate(ctx, dst.KindDevices, "")
+	return nil
 }
 
 // DevicesToJSON prints the devices into JSON to the given writer.
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"text/tabwriter"
 	"time"
 
@@ -14,39 +13,101 @@ import (
 	dst "github.com/xallcloud/api/datastore"
 )
 
-//EventAdd will add a new Event to the datastore database
-func EventAdd(ctx context.Context, client *datastore.Client, ev *dst.Event) (*datastore.Key, error) {
+// EventAdd will add a new Event to the datastore database, after checking it with ValidateEvent.
+// Events for a closed notification are refused with ErrNotificationClosed.
+func EventAdd(ctx context.Context, client *datastore.Client, ev *dst.Event) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "EventAdd", dst.KindEvents, "ntID = "+ev.NtID)
+	defer func() { endSpan(span, noCount, err) }()
+	if err := ValidateEvent(ev); err != nil {
+		return nil, err
+	}
+	if ev.NtID == "" {
+		//do the insert into the database
+		return client.Put(ctx, newIncompleteKey(ctx, dst.KindEvents, nil), newEvent(ev))
+	}
+	// with entity groups, the event is a child of its notification
+	nk, err := groupedNotificationKey(ctx, client, ev.NtID)
+	if err != nil {
+		return nil, err
+	}
+	return eventPutOpen(ctx, client, ev, nk)
+}
+
+// endedKey returns the key of the EvTypeEnded event of the notification, a child of its grouped key nk
+// when not nil. Being unique, it is read and written in the transactions that add events.
+func endedKey(ctx context.Context, ntID string, nk *datastore.Key) *datastore.Key {
+	return newNameKey(ctx, dst.KindEvents, "ended-"+ntID, nk)
+}
+
+// eventPutOpen inserts the event of the notification, unless it is closed, in a transaction that reads
+// its endedKey. An EvTypeEnded event is stored with that key, so concurrent closes and events conflict
+// and only the first one is stored.
+func eventPutOpen(ctx context.Context, client *datastore.Client, ev *dst.Event, nk *datastore.Key) (*datastore.Key, error) {
+	// notifications closed before their EvTypeEnded event had a unique key are found by the query
+	closed, err := notificationClosed(ctx, client, ev.NtID, nk)
+	if err != nil {
+		return nil, err
+	}
+	if closed {
+		return nil, fmt.Errorf("%w. ntID: %s", ErrNotificationClosed, ev.NtID)
+	}
+	ended := endedKey(ctx, ev.NtID, nk)
+	key := newIncompleteKey(ctx, dst.KindEvents, nk)
+	if ev.EvType == EvTypeEnded {
+		key = ended
+	}
+	var pending *datastore.PendingKey
+	commit, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		err := ignoreSchemaVersion(tx.Get(ended, &dst.Event{}))
+		if err == nil {
+			return fmt.Errorf("%w. ntID: %s", ErrNotificationClosed, ev.NtID)
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		pending, err = tx.Put(key, newEvent(ev))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commit.Key(pending), nil
+}
+
+// newEvent copies the event information into the datastore format, with a new Unique ID
+func newEvent(ev *dst.Event) *dst.Event {
 	// Generate a new Unique ID for the event
 	uid := uuid.New()
-	// copy information into the datastore format
-	e := &dst.Event{
+	visibility := ev.Visibility
+	if visibility == "" {
+		visibility = VisibilityAll
+	}
+	return &dst.Event{
 		EvID:          uid.String(),
 		NtID:          ev.NtID,
 		CpID:          ev.CpID,
 		DvID:          ev.DvID,
-		Visibility:    ev.Visibility,
+		Visibility:    visibility,
 		EvType:        ev.EvType,
 		EvSubType:     ev.EvSubType,
 		EvDescription: ev.EvDescription,
 		Created:       time.Now(),
 	}
-	//do the insert into the database
-	key := datastore.IncompleteKey(dst.KindEvents, nil)
-	return client.Put(ctx, key, e)
 }
 
 // EventsGetByCpID will return the list of events with the same cpID
-func EventsGetByCpID(ctx context.Context, client *datastore.Client, cpID string) ([]*dst.Event, error) {
-	log.Println("[EventsGetByCpID] will filter by cpID:", cpID)
+func EventsGetByCpID(ctx context.Context, client *datastore.Client, cpID string) (result []*dst.Event, err error) {
+	ctx, span := startSpan(ctx, "EventsGetByCpID", dst.KindEvents, "cpID = "+cpID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var events []*dst.Event
 	// Create a query to fetch all Events filtered by acID
-	query := datastore.NewQuery(dst.KindEvents).Filter("cpID =", cpID)
-	log.Println("[EventsGetByCpID] will perform query")
-	keys, err := client.GetAll(ctx, query, &events)
+	query := newQuery(ctx, dst.KindEvents).Filter("cpID =", cpID)
+	keys, err := getAll(ctx, client, query, &events)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[EventsGetByCpID] Total keys returned", len(keys))
+	logQuery(ctx, "EventsGetByCpID", dst.KindEvents, cpID, len(keys), start)
 	// Set the ID field on each Event from the corresponding key.
 	for i, key := range keys {
 		events[i].ID = key.ID
@@ -55,9 +116,9 @@ func EventsGetByCpID(ctx context.Context, client *datastore.Client, cpID string)
 }
 
 // EventsGetByAcID will return the list of events with the same acID
-func EventsGetByAcID(ctx context.Context, client *datastore.Client, acID string) ([]*dst.Event, error) {
-	log.Println("[EventsGetByAcID] will filter by acID:", acID)
-	log.Println("[EventsGetByAcID] first get matching notification based on acID:", acID)
+func EventsGetByAcID(ctx context.Context, client *datastore.Client, acID string) (result []*dst.Event, err error) {
+	ctx, span := startSpan(ctx, "EventsGetByAcID", dst.KindEvents, "acID = "+acID)
+	defer func() { endSpan(span, len(result), err) }()
 	notifications, err := NotificationsGetByAcID(ctx, client, acID)
 	if err != nil {
 		return nil, err
@@ -66,7 +127,6 @@ func EventsGetByAcID(ctx context.Context, client *datastore.Client, acID string)
 	if len(notifications) <= 0 {
 		return nil, nil
 	}
-	log.Println("[EventsGetByNtID] will filter by NtID:", notifications[0].NtID)
 
 	// will contain all events with the same Action ID
 	var allEvents []*dst.Event
@@ -89,17 +149,21 @@ func EventsGetByAcID(ctx context.Context, client *datastore.Client, acID string)
 }
 
 // EventsGetByNtID will return the list of events with the same ntID
-func EventsGetByNtID(ctx context.Context, client *datastore.Client, ntID string) ([]*dst.Event, error) {
-	log.Println("[EventsGetByNtID] will filter by ntID:", ntID)
+func EventsGetByNtID(ctx context.Context, client *datastore.Client, ntID string) (result []*dst.Event, err error) {
+	ctx, span := startSpan(ctx, "EventsGetByNtID", dst.KindEvents, "ntID = "+ntID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var events []*dst.Event
-	// Create a query to fetch all Events filtered by acID
-	query := datastore.NewQuery(dst.KindEvents).Filter("ntID =", ntID).Order("created")
-	log.Println("[EventsGetByNtID] will perform query")
-	keys, err := client.GetAll(ctx, query, &events)
+	// Create a query to fetch all Events filtered by ntID, by ancestor when possible
+	nk, err := groupedNotificationKey(ctx, client, ntID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := getAll(ctx, client, eventsQuery(ctx, ntID, nk).Order("created"), &events)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[EventsGetByNtID] Total keys returned", len(keys))
+	logQuery(ctx, "EventsGetByNtID", dst.KindEvents, ntID, len(keys), start)
 	// Set the ID field on each Event from the corresponding key.
 	for i, key := range keys {
 		events[i].ID = key.ID
@@ -108,16 +172,18 @@ func EventsGetByNtID(ctx context.Context, client *datastore.Client, ntID string)
 }
 
 // EventsListAll returns all the events in ascending order of creation time.
-func EventsListAll(ctx context.Context, client *datastore.Client) ([]*dst.Event, error) {
-	log.Println("[EventsListAll] Get all events records")
+func EventsListAll(ctx context.Context, client *datastore.Client) (result []*dst.Event, err error) {
+	ctx, span := startSpan(ctx, "EventsListAll", dst.KindEvents, "")
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var events []*dst.Event
 	// Create a query to fetch all Events entities, ordered by "created".
-	query := datastore.NewQuery(dst.KindEvents).Order("created")
-	keys, err := client.GetAll(ctx, query, &events)
+	query := newQuery(ctx, dst.KindEvents).Order("created")
+	keys, err := getAll(ctx, client, query, &events)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[EventsListAll] Total keys returned", len(keys))
+	logQuery(ctx, "EventsListAll", dst.KindEvents, "", len(keys), start)
 	// Set the id field on each Events from the corresponding DataStore key.
 	for i, key := range keys {
 		events[i].ID = key.ID
@@ -0,0 +1,206 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// DeviceGroup is a set of devices that can be assigned to callpoints as a whole.
+// An assignment targets a group when its dvID is GroupTarget(grID).
+type DeviceGroup struct {
+	ID          int64     `datastore:"-" json:"ID"`
+	GrID        string    `datastore:"grID" json:"grID"`
+	Label       string    `datastore:"label" json:"label"`
+	Description string    `datastore:"description,noindex" json:"description"`
+	Members     []string  `datastore:"members" json:"members"`
+	Created     time.Time `datastore:"created" json:"created"`
+	Changed     time.Time `datastore:"changed" json:"changed"`
+}
+
+// GroupTarget returns the assignment dvID that targets the group
+func GroupTarget(grID string) string {
+	return GroupTargetPrefix + grID
+}
+
+// GroupTargetID returns the grID targeted by the assignment dvID, if it targets a group
+func GroupTargetID(dvID string) (string, bool) {
+	if !strings.HasPrefix(dvID, GroupTargetPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(dvID, GroupTargetPrefix), true
+}
+
+// DeviceGroupAdd will add a new device group to the datastore database
+func DeviceGroupAdd(ctx context.Context, client *datastore.Client, gr *DeviceGroup) (result *datastore.Key, err error) {
+	ctx, span := startSpan(ctx, "DeviceGroupAdd", KindDeviceGroups, "grID = "+gr.GrID)
+	defer func() { endSpan(span, noCount, err) }()
+	// validate the fields before storing
+	if err := ValidateDeviceGroup(gr); err != nil {
+		return nil, err
+	}
+	// first check if there already exists this group by grID:
+	groups, err := DeviceGroupGetByGrID(ctx, client, gr.GrID)
+	if err != nil {
+		return nil, err
+	}
+	// if it has already the value, return key and error
+	if len(groups) > 0 {
+		return &datastore.Key{ID: groups[0].ID, Kind: KindDeviceGroups, Namespace: TenantFromContext(ctx)}, fmt.Errorf("grID allready exists. %d", groups[0].ID)
+	}
+	// copy information into the datastore format
+	n := &DeviceGroup{
+		GrID:        gr.GrID,
+		Label:       gr.Label,
+		Description: gr.Description,
+		Members:     uniqueStrings(gr.Members),
+		Created:     time.Now(),
+		Changed:     time.Now(),
+	}
+	// do the insert into the database
+	key := newIncompleteKey(ctx, KindDeviceGroups, nil)
+	key, err = client.Put(ctx, key, n)
+	if err != nil {
+		return nil, err
+	}
+	// the cached assignments have the group expanded into its members
+	cacheInvalidate(ctx, dst.KindAssignments, "")
+	return key, nil
+}
+
+// DeviceGroupGetByGrID will return the list of device groups with the same grID
+func DeviceGroupGetByGrID(ctx context.Context, client *datastore.Client, grID string) (result []*DeviceGroup, err error) {
+	ctx, span := startSpan(ctx, "DeviceGroupGetByGrID", KindDeviceGroups, "grID = "+grID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
+	var groups []*DeviceGroup
+	// Create a query to fetch all groups filtered by grID
+	query := newQuery(ctx, KindDeviceGroups).Filter("grID =", grID)
+	keys, err := getAll(ctx, client, query, &groups)
+	if err != nil {
+		return nil, err
+	}
+	logQuery(ctx, "DeviceGroupGetByGrID", KindDeviceGroups, grID, len(keys), start)
+	// Set the ID field on each group from the corresponding key.
+	for i, key := range keys {
+		groups[i].ID = key.ID
+	}
+	return groups, nil
+}
+
+// DeviceGroupsListAll returns all the device groups in ascending order of creation time.
+func DeviceGroupsListAll(ctx context.Context, client *datastore.Client) (result []*DeviceGroup, err error) {
+	ctx, span := startSpan(ctx, "DeviceGroupsListAll", KindDeviceGroups, "")
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
+	var groups []*DeviceGroup
+	// Create a query to fetch all groups, ordered by "created".
+	query := newQuery(ctx, KindDeviceGroups).Order("created")
+	keys, err := getAll(ctx, client, query, &groups)
+	if err != nil {
+		return nil, err
+	}
+	logQuery(ctx, "DeviceGroupsListAll", KindDeviceGroups, "", len(keys), start)
+	// Set the id field on each group from the corresponding DataStore key.
+	for i, key := range keys {
+		groups[i].ID = key.ID
+	}
+	return groups, nil
+}
+
+// DeviceGroupDelete will delete a device group from the datastore
+func DeviceGroupDelete(ctx context.Context, client *datastore.Client, grKeyID int64) (err error) {
+	ctx, span := startSpan(ctx, "DeviceGroupDelete", KindDeviceGroups, "__key__ = "+strconv.FormatInt(grKeyID, 10))
+	defer func() { endSpan(span, noCount, err) }()
+	if err := client.Delete(ctx, newIDKey(ctx, KindDeviceGroups, grKeyID, nil)); err != nil {
+		return err
+	}
+	cacheInvalidate(ctx, dst.KindAssignments, "")
+	return nil
+}
+
+// DeviceGroupAddMembers will add the devices to the group. Devices already in the group are ignored.
+func DeviceGroupAddMembers(ctx context.Context, client *datastore.Client, grID string, dvIDs ...string) (err error) {
+	ctx, span := startSpan(ctx, "DeviceGroupAddMembers", KindDeviceGroups, "grID = "+grID)
+	defer func() { endSpan(span, noCount, err) }()
+	for _, dvID := range dvIDs {
+		if !checkReferences(ctx) {
+			break
+		}
+		devices, err := DeviceGetByDvID(ctx, client, dvID)
+		if err != nil {
+			return err
+		}
+		if len(devices) <= 0 {
+			return fmt.Errorf("device not found. dvID: %s", dvID)
+		}
+	}
+	return deviceGroupUpdateMembers(ctx, client, grID, func(members []string) []string {
+		return uniqueStrings(append(members, dvIDs...))
+	})
+}
+
+// DeviceGroupRemoveMembers will remove the devices from the group
+func DeviceGroupRemoveMembers(ctx context.Context, client *datastore.Client, grID string, dvIDs ...string) (err error) {
+	ctx, span := startSpan(ctx, "DeviceGroupRemoveMembers", KindDeviceGroups, "grID = "+grID)
+	defer func() { endSpan(span, noCount, err) }()
+	remove := make(map[string]bool)
+	for _, dvID := range dvIDs {
+		remove[dvID] = true
+	}
+	return deviceGroupUpdateMembers(ctx, client, grID, func(members []string) []string {
+		var kept []string
+		for _, m := range members {
+			if !remove[m] {
+				kept = append(kept, m)
+			}
+		}
+		return kept
+	})
+}
+
+// deviceGroupUpdateMembers changes the members of the group in a transaction
+func deviceGroupUpdateMembers(ctx context.Context, client *datastore.Client, grID string, update func([]string) []string) error {
+	groups, err := DeviceGroupGetByGrID(ctx, client, grID)
+	if err != nil {
+		return err
+	}
+	if len(groups) <= 0 {
+		return fmt.Errorf("device group not found. grID: %s", grID)
+	}
+	key := newIDKey(ctx, KindDeviceGroups, groups[0].ID, nil)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		gr := &DeviceGroup{}
+		if err := ignoreSchemaVersion(tx.Get(key, gr)); err != nil {
+			return err
+		}
+		gr.Members = update(gr.Members)
+		gr.Changed = time.Now()
+		_, err := tx.Put(key, gr)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cacheInvalidate(ctx, dst.KindAssignments, "")
+	return nil
+}
+
+// uniqueStrings returns the values without duplicates, keeping their order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,84 @@
+package gcp
+
+import (
+	"testing"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestAssignmentsByCpIDExpandsGroups(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	if _, err := CallpointAdd(ctx, client, &dst.Callpoint{CpID: "cp-1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, dvID := range []string{"dv-1", "dv-2", "dv-3", "dv-4"} {
+		if _, err := DeviceAdd(ctx, client, &dst.Device{DvID: dvID, Label: "label " + dvID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// dv-2 belongs to both groups, and is also assigned on its own
+	for grID, members := range map[string][]string{"day": {"dv-1", "dv-2"}, "night": {"dv-2", "dv-3"}} {
+		if _, err := DeviceGroupAdd(ctx, client, &DeviceGroup{GrID: grID, Members: members}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []*dst.Assignment{
+		{AsID: "as-day", CpID: "cp-1", DvID: GroupTarget("day"), Level: 2},
+		{AsID: "as-night", CpID: "cp-1", DvID: GroupTarget("night"), Level: 1},
+		{AsID: "as-dv-2", CpID: "cp-1", DvID: "dv-2", Level: 3},
+		{AsID: "as-dv-4", CpID: "cp-1", DvID: "dv-4", Level: 1},
+	} {
+		if _, err := AssignmentAdd(ctx, client, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a group deleted after being assigned reaches nobody
+	if _, err := AssignmentAdd(SkipReferenceChecks(ctx), client, &dst.Assignment{AsID: "as-gone", CpID: "cp-1", DvID: GroupTarget("gone"), Level: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	assignments, err := AssignmentsByCpID(ctx, client, "cp-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels := make(map[string]int)
+	for _, a := range assignments {
+		if _, ok := levels[a.DvID]; ok {
+			t.Fatalf("device %s returned more than once", a.DvID)
+		}
+		levels[a.DvID] = a.Level
+		if a.DeviceObj.DvID != a.DvID || a.DeviceObj.Label != "label "+a.DvID {
+			t.Errorf("device of %s = %+v, want it loaded", a.DvID, a.DeviceObj)
+		}
+	}
+	want := map[string]int{"dv-1": 2, "dv-2": 1, "dv-3": 1, "dv-4": 1}
+	if len(levels) != len(want) {
+		t.Fatalf("levels = %v, want %v", levels, want)
+	}
+	for dvID, level := range want {
+		if levels[dvID] != level {
+			t.Fatalf("levels = %v, want %v", levels, want)
+		}
+	}
+}
+
+func TestDeviceGroupMembers(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	ctx = SkipReferenceChecks(ctx)
+	if _, err := DeviceGroupAdd(ctx, client, &DeviceGroup{GrID: "day", Members: []string{"dv-1", "dv-1", "dv-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeviceGroupAddMembers(ctx, client, "day", "dv-2", "dv-3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeviceGroupRemoveMembers(ctx, client, "day", "dv-1"); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := DeviceGroupGetByGrID(ctx, client, "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0].Members) != 2 || groups[0].Members[0] != "dv-2" || groups[0].Members[1] != "dv-3" {
+		t.Fatalf("groups = %+v, want day with dv-2 and dv-3", groups)
+	}
+}
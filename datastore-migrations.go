@@ -0,0 +1,269 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// SchemaVersionProperty is the integer property stamped with the schema version on each entity migrated.
+// Entities already at the target version are skipped, and the migrations at or below the version of an
+// entity are not applied to it again, even when a page is retried. The helpers of this package ignore it
+// when loading entities into structs that have no field for it.
+const SchemaVersionProperty = "schemaVersion"
+
+// MigrationFunc upgrades a stored entity in place. It must be idempotent, as the entities of
+// a page that failed half-way are migrated again when Migrate resumes.
+type MigrationFunc func(props *datastore.PropertyList) error
+
+// Migration upgrades the entities of a kind to a schema version
+type Migration struct {
+	Kind        string
+	Version     int
+	Description string
+	Up          MigrationFunc
+}
+
+// MigrationProgress is reported after each page of entities migrated
+type MigrationProgress struct {
+	Kind     string
+	Version  int
+	Migrated int
+	Done     bool
+}
+
+// MigrateOptions are the options of Migrate
+type MigrateOptions struct {
+	// PageSize is the number of entities rewritten at a time. Default is 100
+	PageSize int
+	// Progress is called after each page, if set
+	Progress func(MigrationProgress)
+}
+
+// schemaState is the schema version of a kind, stored with the kind as key name.
+// While a migration runs, Target and Cursor allow resuming it after a failure.
+type schemaState struct {
+	Version  int       `datastore:"version"`
+	Target   int       `datastore:"target"`
+	Cursor   string    `datastore:"cursor,noindex"`
+	Migrated int       `datastore:"migrated,noindex"`
+	Changed  time.Time `datastore:"changed"`
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = make(map[string][]Migration)
+)
+
+// RegisterMigration adds a migration. Versions of a kind start at 1 and must be unique.
+// This package registers version 1 of the callpoints, which normalizes their address.
+func RegisterMigration(m Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	for _, r := range migrations[m.Kind] {
+		if r.Version == m.Version {
+			panic(fmt.Sprintf("migration %s version %d already registered", m.Kind, m.Version))
+		}
+	}
+	migrations[m.Kind] = append(migrations[m.Kind], m)
+	sort.Slice(migrations[m.Kind], func(i, j int) bool {
+		return migrations[m.Kind][i].Version < migrations[m.Kind][j].Version
+	})
+}
+
+// SchemaVersion returns the schema version of the stored entities of the kind. 0 means never migrated
+func SchemaVersion(ctx context.Context, client *datastore.Client, kind string) (result int, err error) {
+	ctx, span := startSpan(ctx, "SchemaVersion", KindSchemaMigrations, "kind = "+kind)
+	defer func() { endSpan(span, noCount, err) }()
+	st, err := schemaStateGet(ctx, client, kind)
+	if err != nil {
+		return 0, err
+	}
+	return st.Version, nil
+}
+
+// Migrate runs the registered migrations newer than the schema version of each kind, paging through
+// all its entities. A migration that fails resumes from the last page completed on the next run.
+// It migrates the tenant of the context, see ListTenants to migrate all of them.
+func Migrate(ctx context.Context, client *datastore.Client, opts MigrateOptions) (err error) {
+	ctx, span := startSpan(ctx, "Migrate", KindSchemaMigrations, "")
+	defer func() { endSpan(span, noCount, err) }()
+	if opts.PageSize <= 0 {
+		opts.PageSize = 100
+	}
+	migrationsMu.Lock()
+	var kinds []string
+	pending := make(map[string][]Migration)
+	for kind, ms := range migrations {
+		kinds = append(kinds, kind)
+		pending[kind] = append([]Migration(nil), ms...)
+	}
+	migrationsMu.Unlock()
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		if err := migrateKind(ctx, client, kind, pending[kind], opts); err != nil {
+			return fmt.Errorf("failed to migrate %s. %v", kind, err)
+		}
+	}
+	return nil
+}
+
+// migrateKind applies the migrations above the kind schema version to all its entities
+func migrateKind(ctx context.Context, client *datastore.Client, kind string, ms []Migration, opts MigrateOptions) error {
+	st, err := schemaStateGet(ctx, client, kind)
+	if err != nil {
+		return err
+	}
+	var todo []Migration
+	for _, m := range ms {
+		if m.Version > st.Version {
+			todo = append(todo, m)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	target := todo[len(todo)-1].Version
+	if st.Target != target {
+		// a new target, or the first run: start from the beginning
+		st.Target, st.Cursor, st.Migrated = target, "", 0
+	}
+	logger().InfoContext(ctx, "migrating", LogKeyOp, "Migrate", LogKeyKind, kind, "fromVersion", st.Version, "toVersion", target, "resumeAfter", st.Migrated)
+	for {
+		query := newQuery(ctx, kind).Limit(opts.PageSize)
+		if st.Cursor != "" {
+			cursor, err := datastore.DecodeCursor(st.Cursor)
+			if err != nil {
+				return err
+			}
+			query = query.Start(cursor)
+		}
+		var keys []*datastore.Key
+		var entities []*datastore.PropertyList
+		read := 0
+		it := client.Run(ctx, query)
+		for {
+			props := &datastore.PropertyList{}
+			key, err := it.Next(props)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			read++
+			version := st.Version
+			if v := propertyVersion(props, SchemaVersionProperty); v > version {
+				version = v
+			}
+			if version >= target {
+				continue
+			}
+			for _, m := range todo {
+				if m.Version <= version {
+					continue
+				}
+				if err = m.Up(props); err != nil {
+					return fmt.Errorf("version %d on %v. %v", m.Version, key, err)
+				}
+			}
+			setPropertyVersion(props, SchemaVersionProperty, target)
+			keys = append(keys, key)
+			entities = append(entities, props)
+		}
+		if read == 0 {
+			break
+		}
+		if len(keys) > 0 {
+			if _, err := client.PutMulti(ctx, keys, entities); err != nil {
+				return err
+			}
+			cacheInvalidate(ctx, kind, "")
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			return err
+		}
+		st.Cursor = cursor.String()
+		st.Migrated += len(keys)
+		if err = schemaStatePut(ctx, client, kind, st); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(MigrationProgress{Kind: kind, Version: target, Migrated: st.Migrated})
+		}
+		if read < opts.PageSize {
+			break
+		}
+	}
+	st.Version, st.Cursor = target, ""
+	if err = schemaStatePut(ctx, client, kind, st); err != nil {
+		return err
+	}
+	logger().InfoContext(ctx, "migrated", LogKeyOp, "Migrate", LogKeyKind, kind, "toVersion", target, LogKeyCount, st.Migrated)
+	if opts.Progress != nil {
+		opts.Progress(MigrationProgress{Kind: kind, Version: target, Migrated: st.Migrated, Done: true})
+	}
+	return nil
+}
+
+// propertyVersion returns the schema version stamped on the entity, 0 if it has none
+func propertyVersion(props *datastore.PropertyList, name string) int {
+	for _, p := range *props {
+		if v, ok := p.Value.(int64); ok && p.Name == name {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// setPropertyVersion stamps the schema version on the entity
+func setPropertyVersion(props *datastore.PropertyList, name string, version int) {
+	for i, p := range *props {
+		if p.Name == name {
+			(*props)[i].Value = int64(version)
+			return
+		}
+	}
+	*props = append(*props, datastore.Property{Name: name, Value: int64(version), NoIndex: true})
+}
+
+// ignoreSchemaVersion drops the ErrFieldMismatch of the schema version property, returned when loading
+// a stamped entity into a struct without a field for it, such as the structs of the api package
+func ignoreSchemaVersion(err error) error {
+	var mismatch *datastore.ErrFieldMismatch
+	if errors.As(err, &mismatch) && mismatch.FieldName == SchemaVersionProperty {
+		return nil
+	}
+	return err
+}
+
+// getAll runs the query like client.GetAll, ignoring the schema version stamped by Migrate
+func getAll(ctx context.Context, client *datastore.Client, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	keys, err := client.GetAll(ctx, q, dst)
+	return keys, ignoreSchemaVersion(err)
+}
+
+// schemaStateGet returns the schema state of the kind, empty if it was never migrated
+func schemaStateGet(ctx context.Context, client *datastore.Client, kind string) (*schemaState, error) {
+	st := &schemaState{}
+	err := client.Get(ctx, newNameKey(ctx, KindSchemaMigrations, kind, nil), st)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return st, nil
+}
+
+// schemaStatePut stores the schema state of the kind
+func schemaStatePut(ctx context.Context, client *datastore.Client, kind string, st *schemaState) error {
+	st.Changed = time.Now()
+	_, err := client.Put(ctx, newNameKey(ctx, KindSchemaMigrations, kind, nil), st)
+	return err
+}
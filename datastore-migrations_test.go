@@ -0,0 +1,139 @@
+package gcp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestPropertyVersion(t *testing.T) {
+	props := datastore.PropertyList{{Name: "cpID", Value: "cp-1"}}
+	if v := propertyVersion(&props, "schemaVersion"); v != 0 {
+		t.Fatalf("version of an entity never stamped = %d, want 0", v)
+	}
+	setPropertyVersion(&props, "schemaVersion", 2)
+	setPropertyVersion(&props, "schemaVersion", 3)
+	if v := propertyVersion(&props, "schemaVersion"); v != 3 {
+		t.Fatalf("version = %d, want 3", v)
+	}
+	if len(props) != 2 || !props[1].NoIndex {
+		t.Fatalf("properties = %+v, want cpID and an unindexed schemaVersion", props)
+	}
+}
+
+const kindMigrationTest = "MigrationTest"
+
+var registerTestMigrations sync.Once
+
+func TestIgnoreSchemaVersion(t *testing.T) {
+	stamped := &datastore.ErrFieldMismatch{FieldName: SchemaVersionProperty, Reason: "no such struct field"}
+	other := &datastore.ErrFieldMismatch{FieldName: "label", Reason: "type mismatch"}
+	if err := ignoreSchemaVersion(stamped); err != nil {
+		t.Fatalf("ignoreSchemaVersion(schema version mismatch) = %v, want nil", err)
+	}
+	if err := ignoreSchemaVersion(other); err != other {
+		t.Fatalf("ignoreSchemaVersion(other mismatch) = %v, want it returned", err)
+	}
+	if err := ignoreSchemaVersion(datastore.ErrNoSuchEntity); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("ignoreSchemaVersion(ErrNoSuchEntity) = %v, want it returned", err)
+	}
+}
+
+func TestMigrateSkipsStampedEntities(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	// each migration counts its runs, so a migration applied twice is seen
+	increment := func(name string) MigrationFunc {
+		return func(props *datastore.PropertyList) error {
+			for i, p := range *props {
+				if p.Name == name {
+					(*props)[i].Value = p.Value.(int64) + 1
+					return nil
+				}
+			}
+			*props = append(*props, datastore.Property{Name: name, Value: int64(1)})
+			return nil
+		}
+	}
+	registerTestMigrations.Do(func() {
+		RegisterMigration(Migration{Kind: kindMigrationTest, Version: 1, Up: increment("v1")})
+		RegisterMigration(Migration{Kind: kindMigrationTest, Version: 2, Up: increment("v2")})
+	})
+	entities := []datastore.PropertyList{
+		{{Name: "name", Value: "old"}},
+		// stamped at 1 by a run that failed before version 2 was done
+		{{Name: "name", Value: "half"}, {Name: "v1", Value: int64(1)}, {Name: "schemaVersion", Value: int64(1)}},
+		// already at the target
+		{{Name: "name", Value: "done"}, {Name: "v1", Value: int64(1)}, {Name: "v2", Value: int64(1)}, {Name: "schemaVersion", Value: int64(2)}},
+	}
+	keys := make([]*datastore.Key, len(entities))
+	for i := range entities {
+		keys[i] = newIncompleteKey(ctx, kindMigrationTest, nil)
+	}
+	keys, err := client.PutMulti(ctx, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a cached lookup of the kind is forgotten once its entities are rewritten
+	c, _ := newTestCache(t, CacheOptions{TTL: time.Minute})
+	cached(ctx, kindMigrationTest, "old", func() ([]*struct{}, error) { return []*struct{}{{}}, nil })
+	var done MigrationProgress
+	err = Migrate(ctx, client, MigrateOptions{
+		PageSize: 2,
+		Progress: func(p MigrationProgress) {
+			if p.Kind == kindMigrationTest && p.Done {
+				done = p
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Version != 2 || done.Migrated != 2 {
+		t.Fatalf("progress = %+v, want version 2 with 2 entities rewritten", done)
+	}
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Fatalf("cache entries after the migration = %d, want none", stats.Entries)
+	}
+	got := make([]datastore.PropertyList, len(keys))
+	if err = client.GetMulti(ctx, keys, got); err != nil {
+		t.Fatal(err)
+	}
+	for i, props := range got {
+		values := make(map[string]interface{})
+		for _, p := range props {
+			values[p.Name] = p.Value
+		}
+		if values["v1"] != int64(1) || values["v2"] != int64(1) || values["schemaVersion"] != int64(2) {
+			t.Errorf("entity %s = %v, want each migration applied once and version 2", entities[i][0].Value, values)
+		}
+	}
+}
+
+func TestMigratedEntitiesLoad(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	if _, err := CallpointAdd(ctx, client, &dst.Callpoint{CpID: "cp-1", AbsAddress: "site/room-12"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, client, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var props []datastore.PropertyList
+	if _, err := client.GetAll(ctx, newQuery(ctx, dst.KindCallpoints), &props); err != nil {
+		t.Fatal(err)
+	}
+	if len(props) != 1 || propertyVersion(&props[0], SchemaVersionProperty) != 1 {
+		t.Fatalf("callpoints = %+v, want one stamped with version 1", props)
+	}
+	// the api structs have no field for the stamp
+	cps, err := CallpointGetByCpID(ctx, client, "cp-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cps) != 1 || cps[0].AbsAddress != "site/room-12" {
+		t.Fatalf("callpoints = %+v, want cp-1", cps)
+	}
+}
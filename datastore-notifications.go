@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"text/tabwriter"
 	"time"
 
@@ -14,8 +13,13 @@ import (
 	dst "github.com/xallcloud/api/datastore"
 )
 
-//NotificationAdd will add a new notifications to the datastore database
-func NotificationAdd(ctx context.Context, client *datastore.Client, not *dst.Notification) (*dst.Notification, error) {
+//NotificationAdd will add a new notifications to the datastore database, after checking it with ValidateNotification
+func NotificationAdd(ctx context.Context, client *datastore.Client, not *dst.Notification) (result *dst.Notification, err error) {
+	ctx, span := startSpan(ctx, "NotificationAdd", dst.KindNotifications, "acID = "+not.AcID)
+	defer func() { endSpan(span, noCount, err) }()
+	if err := ValidateNotification(not); err != nil {
+		return nil, err
+	}
 	// Generate a new Unique ID for the notification
 	uid := uuid.New()
 	// copy information into the datastore format
@@ -30,9 +34,22 @@ func NotificationAdd(ctx context.Context, client *datastore.Client, not *dst.Not
 		Options:       not.Options,
 		Created:       time.Now(),
 	}
+	// with entity groups, the notification is a child of its action
+	var parent *datastore.Key
+	if EntityGroupsEnabled() {
+		var err error
+		if parent, err = actionKey(ctx, client, not.AcID); err != nil {
+			return nil, err
+		}
+	}
 	//do the insert into the database
-	key := datastore.IncompleteKey(dst.KindNotifications, nil)
-	dskey, err := client.Put(ctx, key, n)
+	key := newIncompleteKey(ctx, dst.KindNotifications, parent)
+	var dskey *datastore.Key
+	if parent != nil {
+		dskey, err = notificationPutGrouped(ctx, client, key, n)
+	} else {
+		dskey, err = client.Put(ctx, key, n)
+	}
 	if err != nil || key == nil {
 		return nil, err
 	}
@@ -42,17 +59,38 @@ func NotificationAdd(ctx context.Context, client *datastore.Client, not *dst.Not
 }
 
 // NotificationsGetByAcID will return the list of notifications with the same acID
-func NotificationsGetByAcID(ctx context.Context, client *datastore.Client, acID string) ([]*dst.Notification, error) {
-	log.Println("[NotificationsGetByAcID] will filter by acID:", acID)
+func NotificationsGetByAcID(ctx context.Context, client *datastore.Client, acID string) (result []*dst.Notification, err error) {
+	ctx, span := startSpan(ctx, "NotificationsGetByAcID", dst.KindNotifications, "acID = "+acID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var notifications []*dst.Notification
 	// Create a query to fetch all Events filtered by acID
-	query := datastore.NewQuery(dst.KindNotifications).Filter("acID =", acID)
-	log.Println("[NotificationsGetByAcID] will perform query")
-	keys, err := client.GetAll(ctx, query, &notifications)
+	query := newQuery(ctx, dst.KindNotifications).Filter("acID =", acID)
+	keys, err := getAll(ctx, client, query, &notifications)
+	if err != nil {
+		return nil, err
+	}
+	logQuery(ctx, "NotificationsGetByAcID", dst.KindNotifications, acID, len(keys), start)
+	// Set the ID field on each Notification from the corresponding key.
+	for i, key := range keys {
+		notifications[i].ID = key.ID
+	}
+	return notifications, nil
+}
+
+// NotificationGetByNtID will return the list of notifications with the same ntID
+func NotificationGetByNtID(ctx context.Context, client *datastore.Client, ntID string) (result []*dst.Notification, err error) {
+	ctx, span := startSpan(ctx, "NotificationGetByNtID", dst.KindNotifications, "ntID = "+ntID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
+	var notifications []*dst.Notification
+	// Create a query to fetch all Notifications filtered by ntID
+	query := newQuery(ctx, dst.KindNotifications).Filter("ntID =", ntID)
+	keys, err := getAll(ctx, client, query, &notifications)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[NotificationsGetByAcID] Total keys returned", len(keys))
+	logQuery(ctx, "NotificationGetByNtID", dst.KindNotifications, ntID, len(keys), start)
 	// Set the ID field on each Notification from the corresponding key.
 	for i, key := range keys {
 		notifications[i].ID = key.ID
@@ -61,16 +99,18 @@ func NotificationsGetByAcID(ctx context.Context, client *datastore.Client, acID
 }
 
 // NotificationsListAll returns all the notifications in ascending order of creation time.
-func NotificationsListAll(ctx context.Context, client *datastore.Client) ([]*dst.Notification, error) {
-	log.Println("[NotificationsListAll] Get all action records")
+func NotificationsListAll(ctx context.Context, client *datastore.Client) (result []*dst.Notification, err error) {
+	ctx, span := startSpan(ctx, "NotificationsListAll", dst.KindNotifications, "")
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
 	var notifications []*dst.Notification
 	// Create a query to fetch all Notifications entities, ordered by "created".
-	query := datastore.NewQuery(dst.KindNotifications).Order("created")
-	keys, err := client.GetAll(ctx, query, &notifications)
+	query := newQuery(ctx, dst.KindNotifications).Order("created")
+	keys, err := getAll(ctx, client, query, &notifications)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("[NotificationsListAll] Total keys returned", len(keys))
+	logQuery(ctx, "NotificationsListAll", dst.KindNotifications, "", len(keys), start)
 	// Set the id field on each Notifications from the corresponding DataStore key.
 	for i, key := range keys {
 		notifications[i].ID = key.ID
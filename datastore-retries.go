@@ -0,0 +1,62 @@
+package gcp
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// NotificationRetry is the retry counter of a notification dispatched again by ActionRetrigger.
+// It is stored with the ntID as key name, alongside the Notification entity.
+type NotificationRetry struct {
+	NtID string `datastore:"ntID" json:"ntID"`
+	AcID string `datastore:"acID" json:"acID"`
+	// Retry is the number of notifications the action had before this one
+	Retry   int       `datastore:"retry" json:"retry"`
+	Created time.Time `datastore:"created" json:"created"`
+}
+
+// NotificationRetrySet will add or replace the retry counter of a notification
+func NotificationRetrySet(ctx context.Context, client *datastore.Client, r *NotificationRetry) (err error) {
+	ctx, span := startSpan(ctx, "NotificationRetrySet", KindNotificationRetries, "ntID = "+r.NtID)
+	defer func() { endSpan(span, noCount, err) }()
+	if r.Created.IsZero() {
+		r.Created = time.Now()
+	}
+	_, err = client.Put(ctx, newNameKey(ctx, KindNotificationRetries, r.NtID, nil), r)
+	return err
+}
+
+// NotificationRetryGet will return the retry counter of a notification, or nil if it was not dispatched again
+func NotificationRetryGet(ctx context.Context, client *datastore.Client, ntID string) (result *NotificationRetry, err error) {
+	ctx, span := startSpan(ctx, "NotificationRetryGet", KindNotificationRetries, "ntID = "+ntID)
+	defer func() { endSpan(span, noCount, err) }()
+	r := &NotificationRetry{}
+	err = ignoreSchemaVersion(client.Get(ctx, newNameKey(ctx, KindNotificationRetries, ntID, nil), r))
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NotificationRetriesByAcID will return the retry counters of the notifications of the action, in ascending order of retry
+func NotificationRetriesByAcID(ctx context.Context, client *datastore.Client, acID string) (result []*NotificationRetry, err error) {
+	ctx, span := startSpan(ctx, "NotificationRetriesByAcID", KindNotificationRetries, "acID = "+acID)
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
+	var retries []*NotificationRetry
+	query := newQuery(ctx, KindNotificationRetries).Filter("acID =", acID)
+	keys, err := getAll(ctx, client, query, &retries)
+	if err != nil {
+		return nil, err
+	}
+	logQuery(ctx, "NotificationRetriesByAcID", KindNotificationRetries, acID, len(keys), start)
+	// sorted here, as ordering the query by retry needs a composite index
+	sort.Slice(retries, func(i, j int) bool { return retries[i].Retry < retries[j].Retry })
+	return retries, nil
+}
@@ -0,0 +1,206 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// DeviceSchedule has the on-duty shifts of a device. A device without schedule is always on duty.
+// It is stored with the dvID as key name, alongside the Device entity.
+type DeviceSchedule struct {
+	DvID string `datastore:"dvID" json:"dvID"`
+	// Timezone is the IANA name used to read the rules, such as "Europe/Lisbon". Empty is UTC
+	Timezone   string              `datastore:"timezone" json:"timezone"`
+	Rules      []ScheduleRule      `datastore:"rules" json:"rules"`
+	Exceptions []ScheduleException `datastore:"exceptions" json:"exceptions"`
+	Changed    time.Time           `datastore:"changed" json:"changed"`
+}
+
+// ScheduleRule is a weekly shift. Start and End are "15:04" clock times; an End before Start ends the next day.
+type ScheduleRule struct {
+	Weekday time.Weekday `datastore:"weekday" json:"weekday"`
+	Start   string       `datastore:"start" json:"start"`
+	End     string       `datastore:"end" json:"end"`
+}
+
+// ScheduleException overrides the weekly rules between From and To, such as holidays or extra shifts
+type ScheduleException struct {
+	From   time.Time `datastore:"from" json:"from"`
+	To     time.Time `datastore:"to" json:"to"`
+	OnDuty bool      `datastore:"onDuty" json:"onDuty"`
+	Reason string    `datastore:"reason,noindex" json:"reason"`
+}
+
+// OnDuty reports if the schedule has the device on duty at the given time
+func (s *DeviceSchedule) OnDuty(t time.Time) (bool, error) {
+	for _, e := range s.Exceptions {
+		if !t.Before(e.From) && t.Before(e.To) {
+			return e.OnDuty, nil
+		}
+	}
+	loc := time.UTC
+	if s.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return false, fmt.Errorf("invalid schedule timezone '%s'. %v", s.Timezone, err)
+		}
+	}
+	t = t.In(loc)
+	for _, r := range s.Rules {
+		start, err := time.Parse("15:04", r.Start)
+		if err != nil {
+			return false, fmt.Errorf("invalid schedule start '%s'. %v", r.Start, err)
+		}
+		end, err := time.Parse("15:04", r.End)
+		if err != nil {
+			return false, fmt.Errorf("invalid schedule end '%s'. %v", r.End, err)
+		}
+		// check the shift starting today and the one that started yesterday and ends today
+		for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+			if day.Weekday() != r.Weekday {
+				continue
+			}
+			from := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, loc)
+			to := time.Date(day.Year(), day.Month(), day.Day(), end.Hour(), end.Minute(), 0, 0, loc)
+			if !to.After(from) {
+				to = to.AddDate(0, 0, 1)
+			}
+			if !t.Before(from) && t.Before(to) {
+				return true, nil
+			}
+		}
+	}
+	return len(s.Rules) == 0, nil
+}
+
+// DeviceScheduleSet will add or replace the schedule of a device, after checking it with ValidateDeviceSchedule
+func DeviceScheduleSet(ctx context.Context, client *datastore.Client, s *DeviceSchedule) (err error) {
+	ctx, span := startSpan(ctx, "DeviceScheduleSet", KindDeviceSchedules, "dvID = "+s.DvID)
+	defer func() { endSpan(span, noCount, err) }()
+	if err = ValidateDeviceSchedule(s); err != nil {
+		return err
+	}
+	devices, err := DeviceGetByDvID(ctx, client, s.DvID)
+	if err != nil {
+		return err
+	}
+	if len(devices) <= 0 {
+		return fmt.Errorf("device not found. dvID: %s", s.DvID)
+	}
+	s.Changed = time.Now()
+	_, err = client.Put(ctx, newNameKey(ctx, KindDeviceSchedules, s.DvID, nil), s)
+	return err
+}
+
+// DeviceScheduleGet will return the schedule of a device, or nil if it has none
+func DeviceScheduleGet(ctx context.Context, client *datastore.Client, dvID string) (result *DeviceSchedule, err error) {
+	ctx, span := startSpan(ctx, "DeviceScheduleGet", KindDeviceSchedules, "dvID = "+dvID)
+	defer func() { endSpan(span, noCount, err) }()
+	s := &DeviceSchedule{}
+	err = ignoreSchemaVersion(client.Get(ctx, newNameKey(ctx, KindDeviceSchedules, dvID, nil), s))
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// DeviceScheduleDelete will delete the schedule of a device, leaving it always on duty
+func DeviceScheduleDelete(ctx context.Context, client *datastore.Client, dvID string) (err error) {
+	ctx, span := startSpan(ctx, "DeviceScheduleDelete", KindDeviceSchedules, "dvID = "+dvID)
+	defer func() { endSpan(span, noCount, err) }()
+	return client.Delete(ctx, newNameKey(ctx, KindDeviceSchedules, dvID, nil))
+}
+
+// DeviceOnDuty reports if the device is on duty at the given time.
+// A schedule that cannot be read, such as one with an unknown timezone, keeps the device on duty.
+func DeviceOnDuty(ctx context.Context, client *datastore.Client, dvID string, t time.Time) (result bool, err error) {
+	ctx, span := startSpan(ctx, "DeviceOnDuty", KindDeviceSchedules, "dvID = "+dvID)
+	defer func() { endSpan(span, noCount, err) }()
+	s, err := DeviceScheduleGet(ctx, client, dvID)
+	if err != nil {
+		return false, err
+	}
+	return scheduleOnDuty(ctx, s, t), nil
+}
+
+// scheduleOnDuty reports if the schedule has the device on duty, failing open: a missing or
+// invalid schedule must not leave an alarm without anyone to reach.
+func scheduleOnDuty(ctx context.Context, s *DeviceSchedule, t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	ok, err := s.OnDuty(t)
+	if err != nil {
+		logger().WarnContext(ctx, "invalid schedule, device kept on duty", LogKeyOp, "DeviceOnDuty", LogKeyKind, KindDeviceSchedules, LogKeyBusinessID, s.DvID, LogKeyError, err)
+		return true
+	}
+	return ok
+}
+
+// deviceSchedules returns the schedule of each device in a single read, nil for the devices without schedule
+func deviceSchedules(ctx context.Context, client *datastore.Client, dvIDs []string) (map[string]*DeviceSchedule, error) {
+	result := make(map[string]*DeviceSchedule, len(dvIDs))
+	var keys []*datastore.Key
+	var schedules []*DeviceSchedule
+	for _, dvID := range dvIDs {
+		if _, ok := result[dvID]; ok {
+			continue
+		}
+		result[dvID] = nil
+		keys = append(keys, newNameKey(ctx, KindDeviceSchedules, dvID, nil))
+		schedules = append(schedules, &DeviceSchedule{})
+	}
+	if len(keys) == 0 {
+		return result, nil
+	}
+	err := client.GetMulti(ctx, keys, schedules)
+	errs, multi := err.(datastore.MultiError)
+	if err != nil && !multi {
+		return nil, err
+	}
+	for i, key := range keys {
+		if multi && errs[i] == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if multi && ignoreSchemaVersion(errs[i]) != nil {
+			return nil, errs[i]
+		}
+		result[key.Name] = schedules[i]
+	}
+	return result, nil
+}
+
+// AssignmentsOnDutyByCpID will return the assignments of the callpoint whose device is on duty at the given time.
+// Levels where nobody is on duty are left out, so the lowest level returned is the first one that can be reached.
+func AssignmentsOnDutyByCpID(ctx context.Context, client *datastore.Client, cpID string, t time.Time) (result []*dst.Assignment, err error) {
+	ctx, span := startSpan(ctx, "AssignmentsOnDutyByCpID", dst.KindAssignments, "cpID = "+cpID)
+	defer func() { endSpan(span, len(result), err) }()
+	assignments, err := AssignmentsByCpID(ctx, client, cpID)
+	if err != nil {
+		return nil, err
+	}
+	dvIDs := make([]string, len(assignments))
+	for i, a := range assignments {
+		dvIDs[i] = a.DvID
+	}
+	schedules, err := deviceSchedules(ctx, client, dvIDs)
+	if err != nil {
+		return nil, err
+	}
+	var onDuty []*dst.Assignment
+	for _, a := range assignments {
+		if scheduleOnDuty(ctx, schedules[a.DvID], t) {
+			onDuty = append(onDuty, a)
+		}
+	}
+	logger().DebugContext(ctx, "assignments on duty", LogKeyOp, "AssignmentsOnDutyByCpID", LogKeyKind, dst.KindAssignments, LogKeyBusinessID, cpID, LogKeyCount, len(onDuty), "total", len(assignments))
+	return onDuty, nil
+}
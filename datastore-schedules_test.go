@@ -0,0 +1,49 @@
+package gcp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestValidateDeviceSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       DeviceSchedule
+		wantErr bool
+	}{
+		{"valid", DeviceSchedule{DvID: "dv-1", Timezone: "Europe/Lisbon", Rules: []ScheduleRule{{Weekday: time.Monday, Start: "22:00", End: "06:00"}}}, false},
+		{"no rules", DeviceSchedule{DvID: "dv-1"}, false},
+		{"unknown timezone", DeviceSchedule{DvID: "dv-1", Timezone: "Mars/Olympus"}, true},
+		{"bad start", DeviceSchedule{DvID: "dv-1", Rules: []ScheduleRule{{Start: "8am", End: "17:00"}}}, true},
+		{"bad end", DeviceSchedule{DvID: "dv-1", Rules: []ScheduleRule{{Start: "08:00", End: "25:00"}}}, true},
+		{"bad weekday", DeviceSchedule{DvID: "dv-1", Rules: []ScheduleRule{{Weekday: 7, Start: "08:00", End: "17:00"}}}, true},
+		{"empty exception", DeviceSchedule{DvID: "dv-1", Exceptions: []ScheduleException{{From: time.Now(), To: time.Now().Add(-time.Hour)}}}, true},
+		{"no dvID", DeviceSchedule{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDeviceSchedule(&tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateDeviceSchedule = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduleOnDutyFailsOpen(t *testing.T) {
+	ctx := context.Background()
+	monday := time.Date(2020, 1, 6, 12, 0, 0, 0, time.UTC)
+	if !scheduleOnDuty(ctx, nil, monday) {
+		t.Fatal("device without schedule is off duty")
+	}
+	night := &DeviceSchedule{DvID: "dv-1", Rules: []ScheduleRule{{Weekday: time.Monday, Start: "22:00", End: "06:00"}}}
+	if scheduleOnDuty(ctx, night, monday) {
+		t.Fatal("night shift device on duty at noon")
+	}
+	// stored before validation, or with a timezone removed from the tz database
+	broken := &DeviceSchedule{DvID: "dv-1", Timezone: "Mars/Olympus", Rules: night.Rules}
+	if !scheduleOnDuty(ctx, broken, monday) {
+		t.Fatal("device with an invalid schedule is off duty")
+	}
+}
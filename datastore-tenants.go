@@ -0,0 +1,69 @@
+package gcp
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context where all the datastore helpers read and write in the tenant namespace.
+// Without tenant, the default namespace is used.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of the context, empty for the default namespace
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// ListTenants returns the tenants that have entities stored, not including the default namespace
+func ListTenants(ctx context.Context, client *datastore.Client) (result []string, err error) {
+	ctx, span := startSpan(ctx, "ListTenants", "__namespace__", "")
+	defer func() { endSpan(span, len(result), err) }()
+	start := time.Now()
+	keys, err := client.GetAll(ctx, datastore.NewQuery("__namespace__").KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []string
+	for _, k := range keys {
+		if k.Name != "" {
+			tenants = append(tenants, k.Name)
+		}
+	}
+	sort.Strings(tenants)
+	logQuery(ctx, "ListTenants", "__namespace__", "", len(tenants), start)
+	return tenants, nil
+}
+
+// newQuery returns a query of the kind in the tenant namespace of the context
+func newQuery(ctx context.Context, kind string) *datastore.Query {
+	return datastore.NewQuery(kind).Namespace(TenantFromContext(ctx))
+}
+
+// newIncompleteKey returns a new key of the kind in the tenant namespace of the context
+func newIncompleteKey(ctx context.Context, kind string, parent *datastore.Key) *datastore.Key {
+	key := datastore.IncompleteKey(kind, parent)
+	key.Namespace = TenantFromContext(ctx)
+	return key
+}
+
+// newIDKey returns the key with the ID in the tenant namespace of the context
+func newIDKey(ctx context.Context, kind string, id int64, parent *datastore.Key) *datastore.Key {
+	key := datastore.IDKey(kind, id, parent)
+	key.Namespace = TenantFromContext(ctx)
+	return key
+}
+
+// newNameKey returns the key with the name in the tenant namespace of the context
+func newNameKey(ctx context.Context, kind, name string, parent *datastore.Key) *datastore.Key {
+	key := datastore.NameKey(kind, name, parent)
+	key.Namespace = TenantFromContext(ctx)
+	return key
+}
@@ -0,0 +1,71 @@
+package gcp
+
+import (
+	"testing"
+	"time"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	ctxA, client := newTestDatastore(t)
+	tenantA := TenantFromContext(ctxA)
+	tenantB := tenantA + "-b"
+	ctxB := WithTenant(ctxA, tenantB)
+	// the cache must not mix the tenants either
+	SetCache(NewCache(CacheOptions{TTL: time.Minute}))
+	t.Cleanup(func() { SetCache(nil) })
+
+	for _, tc := range []struct {
+		tenant string
+		label  string
+	}{{tenantA, "room A"}, {tenantB, "room B"}} {
+		ctx := WithTenant(ctxA, tc.tenant)
+		// the same business IDs in each tenant
+		if _, err := CallpointAdd(ctx, client, &dst.Callpoint{CpID: "cp-1", Label: tc.label}); err != nil {
+			t.Fatalf("CallpointAdd in %s: %v", tc.tenant, err)
+		}
+		if _, err := DeviceAdd(ctx, client, &dst.Device{DvID: "dv-1", Label: tc.label}); err != nil {
+			t.Fatalf("DeviceAdd in %s: %v", tc.tenant, err)
+		}
+	}
+	for tenant, want := range map[string]string{tenantA: "room A", tenantB: "room B"} {
+		ctx := WithTenant(ctxA, tenant)
+		cps, err := CallpointGetByCpID(ctx, client, "cp-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cps) != 1 || cps[0].Label != want {
+			t.Fatalf("callpoints in %s = %+v, want one labelled %s", tenant, cps, want)
+		}
+		dvs, err := DeviceGetByDvID(ctx, client, "dv-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dvs) != 1 || dvs[0].Label != want {
+			t.Fatalf("devices in %s = %+v, want one labelled %s", tenant, dvs, want)
+		}
+	}
+	// a duplicate is only refused in its own tenant
+	key, err := DeviceAdd(ctxB, client, &dst.Device{DvID: "dv-1"})
+	if err == nil {
+		t.Fatal("duplicate dvID accepted in the same tenant")
+	}
+	if key.Kind != dst.KindDevices || key.Namespace != tenantB {
+		t.Fatalf("duplicate key = %v, want a %s key in %s", key, dst.KindDevices, tenantB)
+	}
+	if _, err = DeviceAdd(WithTenant(ctxA, tenantA+"-c"), client, &dst.Device{DvID: "dv-1"}); err != nil {
+		t.Fatalf("dvID of another tenant refused: %v", err)
+	}
+	tenants, err := ListTenants(ctxA, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, tenant := range tenants {
+		found[tenant] = true
+	}
+	if !found[tenantA] || !found[tenantB] {
+		t.Fatalf("ListTenants = %v, want %s and %s", tenants, tenantA, tenantB)
+	}
+}
@@ -0,0 +1,48 @@
+package gcp
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// newTestDatastore returns a client of the datastore emulator and a context with a tenant of its own,
+// so tests do not see each other's entities. The test is skipped when DATASTORE_EMULATOR_HOST is not set.
+// The emulator must be strongly consistent: gcloud beta emulators datastore start --consistency=1.0
+func newTestDatastore(t *testing.T) (context.Context, *datastore.Client) {
+	t.Helper()
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	project := os.Getenv("DATASTORE_PROJECT_ID")
+	if project == "" {
+		project = "test-project"
+	}
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, project)
+	if err != nil {
+		t.Fatalf("datastore.NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return WithTenant(ctx, "test-"+uuid.New().String()), client
+}
+
+// addTestNotification stores a notification with reply options
+func addTestNotification(ctx context.Context, t *testing.T, client *datastore.Client) *dst.Notification {
+	t.Helper()
+	n, err := NotificationAdd(ctx, client, &dst.Notification{
+		AcID:     "ac-1",
+		Priority: 1,
+		Message:  "fall detected in room 12",
+		Options:  "OK,NO",
+	})
+	if err != nil {
+		t.Fatalf("NotificationAdd: %v", err)
+	}
+	return n
+}
@@ -0,0 +1,283 @@
+package gcp
+
+//This file will contain the glue from a new action to the notification of its devices
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+
+	dst "github.com/xallcloud/api/datastore"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes set on the delivery jobs published by the dispatcher
+const (
+	AttrNtID  = "ntID"
+	AttrDvID  = "dvID"
+	AttrLevel = "level"
+)
+
+// Dispatcher turns new actions into notifications and publishes one delivery job per assigned device
+type Dispatcher struct {
+	ds    *datastore.Client
+	topic *pubsub.Topic
+
+	// mu guards the clock and the fast lane, which can be changed while dispatching
+	mu    sync.Mutex
+	clock Clock
+	// fastLane receives the notifications with priority from fastLanePriority, see EnableFastLane
+	fastLane         *pubsub.Topic
+	fastLanePriority int
+}
+
+// NewDispatcher returns a dispatcher that publishes the delivery jobs to the given topic
+func NewDispatcher(ds *datastore.Client, topic *pubsub.Topic) *Dispatcher {
+	return &Dispatcher{ds: ds, topic: topic, clock: systemClock{}}
+}
+
+// SetClock replaces the clock used to find the devices on duty
+func (d *Dispatcher) SetClock(c Clock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clock = c
+}
+
+// now returns the time of the dispatcher clock
+func (d *Dispatcher) now() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.clock.Now()
+}
+
+// DispatchHandle identifies a dispatched notification and allows polling its status
+type DispatchHandle struct {
+	NtID    string
+	AcID    string
+	CpID    string
+	Devices []string
+	// Retry is the number of times the action was triggered before this notification
+	Retry int
+	d     *Dispatcher
+}
+
+// Escalation is the level a notification was escalated to and the devices reached at it
+type Escalation struct {
+	Level   int
+	Devices []*dst.Device
+}
+
+// DispatchStatus is the progress of a notification, built from its events
+type DispatchStatus struct {
+	NtID string
+	// Devices has the last event subtype of each device (reaching, delivered, failed, ...)
+	Devices map[string]string
+	Ended   bool
+	Events  []*dst.Event
+}
+
+// Dispatch creates the notification for the action, records its start events and publishes the delivery jobs
+// for the devices assigned at the lowest level of the callpoint with a device that accepts its priority.
+func (d *Dispatcher) Dispatch(ctx context.Context, ac *dst.Action) (*DispatchHandle, error) {
+	logger().InfoContext(ctx, "dispatching action", LogKeyOp, "Dispatch", LogKeyKind, dst.KindActions, LogKeyBusinessID, ac.AcID, "cpID", ac.CpID)
+	cps, err := CallpointGetByCpID(ctx, d.ds, ac.CpID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cps) <= 0 {
+		return nil, fmt.Errorf("callpoint not found. cpID: %s", ac.CpID)
+	}
+	cp := cps[0]
+	priority := NotificationPriority(cp, ac)
+	assignments, err := AssignmentsOnDutyByCpID(ctx, d.ds, cp.CpID, d.now())
+	if err != nil {
+		return nil, err
+	}
+	assignments = reachable(ctx, assignments, priority)
+	n, err := NotificationAdd(ctx, d.ds, &dst.Notification{
+		AcID:     ac.AcID,
+		Priority: priority,
+		Message:  ac.Description,
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics().NotificationStarted()
+	h := &DispatchHandle{NtID: n.NtID, AcID: ac.AcID, CpID: cp.CpID, d: d}
+	_, err = EventAdd(ctx, d.ds, &dst.Event{
+		NtID:          n.NtID,
+		CpID:          cp.CpID,
+		Visibility:    VisibilityAll,
+		EvType:        EvTypeStart,
+		EvSubType:     EvSubTypeStartStep1,
+		EvDescription: fmt.Sprintf("action %s on callpoint %s", ac.AcID, cp.Label),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// only the first level is reached now, the next levels are reached by Escalate
+	devices, err := d.publishLevel(ctx, n, cp.CpID, assignments, lowestLevel(assignments))
+	if err != nil {
+		return nil, err
+	}
+	for _, dv := range devices {
+		h.Devices = append(h.Devices, dv.DvID)
+	}
+	logger().InfoContext(ctx, "notification published", LogKeyOp, "Dispatch", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, n.NtID, LogKeyCount, len(h.Devices))
+	return h, nil
+}
+
+// Escalate publishes the notification to the on-duty devices assigned at the given level, or at the next
+// level with someone on duty that accepts its priority. It returns the level and the devices reached, nil when there is no such level.
+func (d *Dispatcher) Escalate(ctx context.Context, ntID string, level int) (*Escalation, error) {
+	logger().InfoContext(ctx, "escalating notification", LogKeyOp, "Escalate", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, ntID, "level", level)
+	nts, err := NotificationGetByNtID(ctx, d.ds, ntID)
+	if err != nil {
+		return nil, err
+	}
+	if len(nts) <= 0 {
+		return nil, fmt.Errorf("notification not found. ntID: %s", ntID)
+	}
+	acs, err := ActionGetByAcID(ctx, d.ds, nts[0].AcID)
+	if err != nil {
+		return nil, err
+	}
+	if len(acs) <= 0 {
+		return nil, fmt.Errorf("action not found. acID: %s", nts[0].AcID)
+	}
+	assignments, err := AssignmentsOnDutyByCpID(ctx, d.ds, acs[0].CpID, d.now())
+	if err != nil {
+		return nil, err
+	}
+	assignments = reachable(ctx, assignments, nts[0].Priority)
+	next, ok := nextLevel(assignments, level)
+	if !ok {
+		logger().InfoContext(ctx, "no level with devices on duty", LogKeyOp, "Escalate", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, ntID, "level", level)
+		return nil, nil
+	}
+	devices, err := d.publishLevel(ctx, nts[0], acs[0].CpID, assignments, next)
+	if err != nil {
+		return nil, err
+	}
+	return &Escalation{Level: next, Devices: devices}, nil
+}
+
+// publishLevel publishes the delivery jobs for the assignments of the given level and records the services events
+func (d *Dispatcher) publishLevel(ctx context.Context, n *dst.Notification, cpID string, assignments []*dst.Assignment, level int) ([]*dst.Device, error) {
+	var devices []*dst.Device
+	for _, a := range assignments {
+		if a.Level != level {
+			continue
+		}
+		if err := d.publish(ctx, MessageKindNotification, n, a.DvID, a.Level); err != nil {
+			return nil, err
+		}
+		_, err := EventAdd(ctx, d.ds, &dst.Event{
+			NtID:          n.NtID,
+			CpID:          cpID,
+			DvID:          a.DvID,
+			Visibility:    VisibilityServer,
+			EvType:        EvTypeServices,
+			EvDescription: fmt.Sprintf("delivery to %s queued at level %d", a.DeviceObj.Label, level),
+		})
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, &a.DeviceObj)
+	}
+	return devices, nil
+}
+
+// reachable returns the assignments with a device that accepts the priority, so the level reached is
+// chosen among them and a level where no device can be reached is skipped
+func reachable(ctx context.Context, assignments []*dst.Assignment, priority int) []*dst.Assignment {
+	var result []*dst.Assignment
+	for _, a := range assignments {
+		if a.DeviceObj.DvID == "" {
+			logger().DebugContext(ctx, "skip assignment without device", LogKeyOp, "Dispatch", LogKeyKind, dst.KindAssignments, LogKeyBusinessID, a.AsID)
+			continue
+		}
+		if !DeviceAccepts(&a.DeviceObj, priority) {
+			logger().DebugContext(ctx, "skip device below its priority threshold", LogKeyOp, "Dispatch", LogKeyKind, dst.KindDevices, LogKeyBusinessID, a.DvID)
+			continue
+		}
+		result = append(result, a)
+	}
+	return result
+}
+
+// lowestLevel returns the first escalation level of the assignments
+func lowestLevel(assignments []*dst.Assignment) int {
+	level := 0
+	for i, a := range assignments {
+		if i == 0 || a.Level < level {
+			level = a.Level
+		}
+	}
+	return level
+}
+
+// nextLevel returns the lowest level of the assignments equal or above the given level
+func nextLevel(assignments []*dst.Assignment, level int) (int, bool) {
+	next, found := 0, false
+	for _, a := range assignments {
+		if a.Level >= level && (!found || a.Level < next) {
+			next, found = a.Level, true
+		}
+	}
+	return next, found
+}
+
+// publish sends the message of the given kind about the notification to a device
+func (d *Dispatcher) publish(ctx context.Context, kind string, n *dst.Notification, dvID string, level int) (err error) {
+	topic := d.topicFor(n)
+	ctx, span := startSpan(ctx, "publish "+kind, "topic", topic.ID(), trace.WithSpanKind(trace.SpanKindProducer))
+	defer func() { endSpan(span, noCount, err) }()
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	attrs := map[string]string{
+		AttrKind:  kind,
+		AttrNtID:  n.NtID,
+		AttrDvID:  dvID,
+		AttrLevel: strconv.Itoa(level),
+	}
+	InjectTraceContext(ctx, attrs)
+	res := topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attrs})
+	_, err = res.Get(ctx)
+	metrics().Published(topic.ID(), kind, outcome(err))
+	if err != nil {
+		return fmt.Errorf("failed to publish %s to '%s'. %v", kind, dvID, err)
+	}
+	return nil
+}
+
+// Handle returns the handle of an already dispatched notification
+func (d *Dispatcher) Handle(ntID string) *DispatchHandle {
+	return &DispatchHandle{NtID: ntID, d: d}
+}
+
+// Status loads the events of the notification and summarizes them
+func (h *DispatchHandle) Status(ctx context.Context) (*DispatchStatus, error) {
+	events, err := EventsGetByNtID(ctx, h.d.ds, h.NtID)
+	if err != nil {
+		return nil, err
+	}
+	s := &DispatchStatus{NtID: h.NtID, Devices: make(map[string]string), Events: events}
+	for _, e := range events {
+		switch {
+		case e.EvType == EvTypeEnded:
+			s.Ended = true
+		case e.EvType == EvTypeDevices && e.DvID != "":
+			s.Devices[e.DvID] = e.EvSubType
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,211 @@
+package gcp
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub/pstest"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// newTestDispatcher returns a dispatcher publishing to the "jobs" topic of an in-memory pubsub server
+func newTestDispatcher(ctx context.Context, t *testing.T, client *datastore.Client) (*Dispatcher, *pstest.Server) {
+	t.Helper()
+	ps := newTestPubSub(t)
+	topic, err := CreateTopicContext(ctx, "jobs", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(topic.Stop)
+	return NewDispatcher(client, topic), ps.Server
+}
+
+// addTestAssignment stores the device and assigns it to the callpoint at the level
+func addTestAssignment(ctx context.Context, t *testing.T, client *datastore.Client, cpID string, dv *dst.Device, level int) {
+	t.Helper()
+	if _, err := DeviceAdd(ctx, client, dv); err != nil {
+		t.Fatalf("DeviceAdd: %v", err)
+	}
+	asgn := &dst.Assignment{AsID: cpID + "/" + dv.DvID, CpID: cpID, DvID: dv.DvID, Level: level}
+	if _, err := AssignmentAdd(ctx, client, asgn); err != nil {
+		t.Fatalf("AssignmentAdd: %v", err)
+	}
+}
+
+// addTestAction stores the callpoint cp-1 and an action on it
+func addTestAction(ctx context.Context, t *testing.T, client *datastore.Client, cp *dst.Callpoint) *dst.Action {
+	t.Helper()
+	if _, err := CallpointAdd(ctx, client, cp); err != nil {
+		t.Fatalf("CallpointAdd: %v", err)
+	}
+	ac := &dst.Action{AcID: "ac-1", CpID: cp.CpID, Description: "fall detected"}
+	if _, err := ActionAdd(ctx, client, ac); err != nil {
+		t.Fatalf("ActionAdd: %v", err)
+	}
+	return ac
+}
+
+// jobs returns the level of each device the delivery jobs of the notification were published to
+func jobs(srv *pstest.Server, ntID string) map[string]string {
+	levels := make(map[string]string)
+	for _, m := range srv.Messages() {
+		if m.Attributes[AttrNtID] == ntID && m.Attributes[AttrKind] == MessageKindNotification {
+			levels[m.Attributes[AttrDvID]] = m.Attributes[AttrLevel]
+		}
+	}
+	return levels
+}
+
+func TestDispatch(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, srv := newTestDispatcher(ctx, t, client)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1", Label: "room 12", Priority: 2})
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-2"}, 1)
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-3"}, 2)
+
+	h, err := d.Dispatch(ctx, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(h.Devices)
+	if h.AcID != "ac-1" || h.CpID != "cp-1" || strings.Join(h.Devices, ",") != "dv-1,dv-2" {
+		t.Fatalf("handle = %+v, want ac-1 on cp-1 reaching dv-1,dv-2", h)
+	}
+	nts, err := NotificationGetByNtID(ctx, client, h.NtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nts) != 1 || nts[0].AcID != "ac-1" || nts[0].Priority != 2 || nts[0].Message != "fall detected" {
+		t.Fatalf("notifications = %+v, want one for ac-1 with the callpoint priority", nts)
+	}
+
+	// one job per device of the first level
+	got := jobs(srv, h.NtID)
+	if len(got) != 2 || got["dv-1"] != "1" || got["dv-2"] != "1" {
+		t.Fatalf("jobs = %v, want dv-1 and dv-2 at level 1", got)
+	}
+
+	events, err := EventsGetByNtID(ctx, client, h.NtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts, services := 0, make(map[string]bool)
+	for _, e := range events {
+		switch e.EvType {
+		case EvTypeStart:
+			starts++
+			if e.CpID != "cp-1" {
+				t.Errorf("start event on %q, want cp-1", e.CpID)
+			}
+		case EvTypeServices:
+			services[e.DvID] = true
+		}
+	}
+	if starts != 1 || len(services) != 2 || !services["dv-1"] || !services["dv-2"] {
+		t.Fatalf("events: %d start, services %v; want 1 start and services for dv-1 and dv-2", starts, services)
+	}
+}
+
+func TestDispatchStatus(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, _ := newTestDispatcher(ctx, t, client)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+
+	h, err := d.Dispatch(ctx, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := h.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Ended || len(s.Devices) != 0 || len(s.Events) != 2 {
+		t.Fatalf("status after dispatch = %+v, want open with the start and services events", s)
+	}
+	if err = recordDelivery(ctx, client, &dst.Device{DvID: "dv-1"}, &dst.Notification{NtID: h.NtID}, EvSubTypeDelivered, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	// a handle built from the ntID polls the same notification
+	s, err = d.Handle(h.NtID).Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Ended || s.Devices["dv-1"] != EvSubTypeDelivered {
+		t.Fatalf("status after delivery = %+v, want dv-1 delivered", s)
+	}
+	if err = NotificationClose(ctx, client, h.NtID, EvSubTypeAcknowledged); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = h.Status(ctx); err != nil || !s.Ended {
+		t.Fatalf("status after close = %+v, %v; want ended", s, err)
+	}
+}
+
+func TestDispatchUsesClock(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, srv := newTestDispatcher(ctx, t, client)
+	clock := newFakeClock()
+	d.SetClock(clock)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-2"}, 2)
+	// dv-1 is off duty around the time of the fake clock only
+	err := DeviceScheduleSet(ctx, client, &DeviceSchedule{
+		DvID:       "dv-1",
+		Exceptions: []ScheduleException{{From: clock.Now().Add(-time.Hour), To: clock.Now().Add(time.Hour), OnDuty: false}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := d.Dispatch(ctx, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := jobs(srv, h.NtID); len(got) != 1 || got["dv-2"] != "2" {
+		t.Fatalf("jobs = %v, want dv-2 at level 2 while dv-1 is off duty", got)
+	}
+}
+
+func TestDispatchFallsThroughUnreachableLevel(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		level func(ctx context.Context, t *testing.T, client *datastore.Client)
+	}{
+		{"device below its priority threshold", func(ctx context.Context, t *testing.T, client *datastore.Client) {
+			addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1", Priority: 5}, 1)
+		}},
+		{"device not found", func(ctx context.Context, t *testing.T, client *datastore.Client) {
+			asgn := &dst.Assignment{AsID: "cp-1/dv-gone", CpID: "cp-1", DvID: "dv-gone", Level: 1}
+			if _, err := AssignmentAdd(SkipReferenceChecks(ctx), client, asgn); err != nil {
+				t.Fatalf("AssignmentAdd: %v", err)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, client := newTestDatastore(t)
+			d, srv := newTestDispatcher(ctx, t, client)
+			ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1", Priority: 2})
+			tc.level(ctx, t, client)
+			addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-2"}, 2)
+
+			h, err := d.Dispatch(ctx, ac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(h.Devices) != 1 || h.Devices[0] != "dv-2" {
+				t.Fatalf("devices = %v, want dv-2 of level 2", h.Devices)
+			}
+			if got := jobs(srv, h.NtID); len(got) != 1 || got["dv-2"] != "2" {
+				t.Fatalf("jobs = %v, want dv-2 at level 2", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package gcp
+
+//This file will contain the structured logging of the package
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// keys of the structured log fields
+const (
+	LogKeyOp         = "op"
+	LogKeyKind       = "kind"
+	LogKeyBusinessID = "businessID"
+	LogKeyCount      = "count"
+	LogKeyDuration   = "duration"
+	LogKeyTenant     = "tenant"
+	LogKeyError      = "error"
+)
+
+var pkgLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger of the package. By default nothing is logged; nil restores the default.
+// Queries are logged at debug level, changes at info level and failures that are not returned at warn level.
+func SetLogger(l *slog.Logger) {
+	pkgLogger.Store(l)
+}
+
+// logger returns the logger of the package
+func logger() *slog.Logger {
+	if l := pkgLogger.Load(); l != nil {
+		return l
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a handler that drops all the records
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// NewCloudLoggingHandler returns a handler that writes JSON lines understood by Cloud Logging,
+// with the level as "severity" and the text as "message", for the logs read from stdout or stderr.
+func NewCloudLoggingHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				a.Key = "severity"
+				if level, ok := a.Value.Any().(slog.Level); ok {
+					a.Value = slog.StringValue(severity(level))
+				}
+			case slog.MessageKey:
+				a.Key = "message"
+			case LogKeyDuration:
+				if a.Value.Kind() != slog.KindDuration {
+					break
+				}
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			return a
+		},
+	})
+}
+
+// severity returns the Cloud Logging severity of the level. Levels between two slog levels take the lower one.
+func severity(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < slog.LevelWarn:
+		return "INFO"
+	case level < slog.LevelError:
+		return "WARNING"
+	}
+	return "ERROR"
+}
+
+// logQuery logs a datastore query of the kind filtered by the business ID, empty for all the entities
+func logQuery(ctx context.Context, op, kind, businessID string, count int, start time.Time) {
+	l := logger()
+	if !l.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	l.LogAttrs(ctx, slog.LevelDebug, "query",
+		slog.String(LogKeyOp, op),
+		slog.String(LogKeyKind, kind),
+		slog.String(LogKeyBusinessID, businessID),
+		slog.Int(LogKeyCount, count),
+		slog.Duration(LogKeyDuration, time.Since(start)),
+		slog.String(LogKeyTenant, TenantFromContext(ctx)),
+	)
+}
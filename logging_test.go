@@ -0,0 +1,78 @@
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestDefaultLoggerDiscards(t *testing.T) {
+	SetLogger(nil)
+	if logger().Enabled(context.Background(), slog.LevelError) {
+		t.Fatal("default logger is enabled, want it to discard everything")
+	}
+	// logging does not fail without a logger
+	logger().Error("dropped", LogKeyOp, "TestDefaultLoggerDiscards")
+	logQuery(context.Background(), "TestDefaultLoggerDiscards", "Kind", "", 0, time.Now())
+}
+
+func TestSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	SetLogger(l)
+	t.Cleanup(func() { SetLogger(nil) })
+	if logger() != l {
+		t.Fatal("logger() is not the logger set")
+	}
+	logQuery(WithTenant(context.Background(), "tenant-1"), "TestSetLogger", "Kind", "id-1", 3, time.Now())
+	for _, want := range []string{"msg=query", "op=TestSetLogger", "kind=Kind", "businessID=id-1", "count=3", "tenant=tenant-1"} {
+		if !bytes.Contains(buf.Bytes(), []byte(want)) {
+			t.Errorf("log %q does not contain %q", buf.String(), want)
+		}
+	}
+	SetLogger(nil)
+	if logger() != discardLogger {
+		t.Fatal("SetLogger(nil) did not restore the default logger")
+	}
+}
+
+func TestCloudLoggingHandler(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  string
+	}{
+		{slog.LevelDebug, "DEBUG"},
+		{slog.LevelInfo, "INFO"},
+		{slog.LevelInfo + 2, "INFO"},
+		{slog.LevelWarn, "WARNING"},
+		{slog.LevelError, "ERROR"},
+		{slog.LevelError + 4, "ERROR"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		l := slog.New(NewCloudLoggingHandler(&buf, slog.LevelDebug))
+		l.Log(context.Background(), tt.level, "device timeout", LogKeyOp, "Watchdog", LogKeyDuration, 1500*time.Millisecond)
+		var line map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("level %v: %v in %q", tt.level, err, buf.String())
+		}
+		if line["severity"] != tt.want || line["message"] != "device timeout" {
+			t.Errorf("level %v: severity %v, message %v; want %s, device timeout", tt.level, line["severity"], line["message"], tt.want)
+		}
+		if _, ok := line[slog.LevelKey]; ok {
+			t.Errorf("level %v: line has the %q key too", tt.level, slog.LevelKey)
+		}
+		if line[LogKeyOp] != "Watchdog" || line[LogKeyDuration] != "1.5s" {
+			t.Errorf("level %v: attributes %v", tt.level, line)
+		}
+	}
+	// records below the level are dropped
+	var buf bytes.Buffer
+	slog.New(NewCloudLoggingHandler(&buf, slog.LevelInfo)).Debug("query")
+	if buf.Len() != 0 {
+		t.Fatalf("debug record written at info level: %q", buf.String())
+	}
+}
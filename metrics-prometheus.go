@@ -0,0 +1,146 @@
+package gcp
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsNamespace is the prefix of the names of the Prometheus metrics
+const MetricsNamespace = "xallcloud"
+
+// PrometheusMetrics implements Metrics with Prometheus collectors
+type PrometheusMetrics struct {
+	registry *prometheus.Registry
+
+	operations           *prometheus.CounterVec
+	operationDuration    *prometheus.HistogramVec
+	published            *prometheus.CounterVec
+	acked                *prometheus.CounterVec
+	notificationsStarted prometheus.Counter
+	notificationsEnded   *prometheus.CounterVec
+	deviceOutcomes       *prometheus.CounterVec
+	timeToAcknowledge    prometheus.Histogram
+	cacheLookups         *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics returns the metrics registered in the registry, or in a new registry when nil
+func NewPrometheusMetrics(registry *prometheus.Registry) (*PrometheusMetrics, error) {
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+	m := &PrometheusMetrics{
+		registry: registry,
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "operations_total",
+			Help:      "Datastore and pubsub operations by kind and outcome.",
+		}, []string{"op", "kind", "outcome"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of the datastore and pubsub operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op", "kind"}),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "messages_published_total",
+			Help:      "Messages published by topic, message kind and outcome.",
+		}, []string{"topic", "kind", "outcome"}),
+		acked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "messages_acked_total",
+			Help:      "Messages received by subscription, message kind and outcome, error when nacked.",
+		}, []string{"subscription", "kind", "outcome"}),
+		notificationsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "notifications_started_total",
+			Help:      "Notifications dispatched.",
+		}),
+		notificationsEnded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "notifications_ended_total",
+			Help:      "Notifications closed by reason.",
+		}, []string{"reason"}),
+		deviceOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "device_outcomes_total",
+			Help:      "Devices delivered, failed or timed out by device type.",
+		}, []string{"device_type", "outcome"}),
+		timeToAcknowledge: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "time_to_acknowledge_seconds",
+			Help:      "Time from the creation of a notification until it is closed as acknowledged.",
+			// from 5 seconds to about 40 minutes
+			Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+		}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "cache_lookups_total",
+			Help:      "Cache lookups by datastore kind and result, hit or miss.",
+		}, []string{"kind", "result"}),
+	}
+	collectors := []prometheus.Collector{
+		m.operations, m.operationDuration, m.published, m.acked,
+		m.notificationsStarted, m.notificationsEnded, m.deviceOutcomes, m.timeToAcknowledge, m.cacheLookups,
+	}
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Handler returns the HTTP handler that exposes the metrics of the registry, to be served at /metrics
+func (m *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Operation implements Metrics
+func (m *PrometheusMetrics) Operation(op, kind, outcome string, d time.Duration) {
+	m.operations.WithLabelValues(op, kind, outcome).Inc()
+	m.operationDuration.WithLabelValues(op, kind).Observe(d.Seconds())
+}
+
+// Published implements Metrics
+func (m *PrometheusMetrics) Published(topic, kind, outcome string) {
+	m.published.WithLabelValues(topic, kind, outcome).Inc()
+}
+
+// Acked implements Metrics
+func (m *PrometheusMetrics) Acked(subscription, kind, outcome string) {
+	m.acked.WithLabelValues(subscription, kind, outcome).Inc()
+}
+
+// NotificationStarted implements Metrics
+func (m *PrometheusMetrics) NotificationStarted() {
+	m.notificationsStarted.Inc()
+}
+
+// NotificationEnded implements Metrics
+func (m *PrometheusMetrics) NotificationEnded(reason string) {
+	m.notificationsEnded.WithLabelValues(reason).Inc()
+}
+
+// DeviceOutcome implements Metrics
+func (m *PrometheusMetrics) DeviceOutcome(dvType int, outcome string) {
+	m.deviceOutcomes.WithLabelValues(strconv.Itoa(dvType), outcome).Inc()
+}
+
+// TimeToAcknowledge implements Metrics
+func (m *PrometheusMetrics) TimeToAcknowledge(d time.Duration) {
+	m.timeToAcknowledge.Observe(d.Seconds())
+}
+
+// CacheLookup implements Metrics
+func (m *PrometheusMetrics) CacheLookup(kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(kind, result).Inc()
+}
@@ -0,0 +1,79 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the metrics exposed by the handler, as served at /metrics
+func scrape(t *testing.T, m *PrometheusMetrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("GET /metrics = %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	m, err := NewPrometheusMetrics(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetMetrics(m)
+	t.Cleanup(func() { SetMetrics(nil) })
+
+	// the helpers measure their operations when they end
+	for _, err := range []error{nil, nil, errors.New("unavailable")} {
+		_, op := startSpan(context.Background(), "EventAdd", "Events", "")
+		endSpan(op, noCount, err)
+	}
+	m.Published("jobs", MessageKindNotification, OutcomeOK)
+	m.Published("jobs", MessageKindNotification, OutcomeError)
+	m.Acked("jobs-worker", MessageKindNotification, OutcomeOK)
+	m.NotificationStarted()
+	m.NotificationEnded(EvSubTypeAcknowledged)
+	m.NotificationEnded(EvSubTypeAcknowledged)
+	m.NotificationEnded(EvSubTypeExpired)
+	m.TimeToAcknowledge(8 * time.Second)
+	m.TimeToAcknowledge(62 * time.Second)
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`xallcloud_operations_total{kind="Events",op="EventAdd",outcome="ok"} 2`,
+		`xallcloud_operations_total{kind="Events",op="EventAdd",outcome="error"} 1`,
+		`xallcloud_operation_duration_seconds_count{kind="Events",op="EventAdd"} 3`,
+		`xallcloud_messages_published_total{kind="notification",outcome="ok",topic="jobs"} 1`,
+		`xallcloud_messages_published_total{kind="notification",outcome="error",topic="jobs"} 1`,
+		`xallcloud_messages_acked_total{kind="notification",outcome="ok",subscription="jobs-worker"} 1`,
+		`xallcloud_notifications_started_total 1`,
+		`xallcloud_notifications_ended_total{reason="` + EvSubTypeAcknowledged + `"} 2`,
+		`xallcloud_notifications_ended_total{reason="` + EvSubTypeExpired + `"} 1`,
+		`xallcloud_time_to_acknowledge_seconds_bucket{le="10"} 1`,
+		`xallcloud_time_to_acknowledge_seconds_bucket{le="80"} 2`,
+		`xallcloud_time_to_acknowledge_seconds_sum 70`,
+		`xallcloud_time_to_acknowledge_seconds_count 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("/metrics has no line %s", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestPrometheusMetricsRegisteredOnce(t *testing.T) {
+	m, err := NewPrometheusMetrics(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewPrometheusMetrics(m.registry); err == nil {
+		t.Fatal("metrics registered twice in the same registry, want error")
+	}
+}
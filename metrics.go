@@ -0,0 +1,83 @@
+package gcp
+
+//This file will contain the metrics of the operations and notifications
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// outcomes of the operations and of the messages published and received
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// Metrics receives the measurements of the package, see SetMetrics. Implementations must be safe
+// for concurrent use, and fast, as they are called in line with the helpers.
+type Metrics interface {
+	// Operation is called at the end of each datastore and pubsub helper. kind is the datastore kind,
+	// "topic" or "subscription"
+	Operation(op, kind, outcome string, d time.Duration)
+	// Published is called for each message published, with its message kind
+	Published(topic, kind, outcome string)
+	// Acked is called for each message received, with OutcomeOK when acked and OutcomeError when nacked
+	Acked(subscription, kind, outcome string)
+	// NotificationStarted is called for each notification dispatched
+	NotificationStarted()
+	// NotificationEnded is called for each notification closed, with the reason (EvSubTypeAcknowledged, ...)
+	NotificationEnded(reason string)
+	// DeviceOutcome is called when a device is reached, with EvSubTypeDelivered, EvSubTypeFailed or EvSubTypeTimeout
+	DeviceOutcome(dvType int, outcome string)
+	// TimeToAcknowledge is called for each notification closed as acknowledged, with the time since it was created
+	TimeToAcknowledge(d time.Duration)
+	// CacheLookup is called for each lookup of the cache, with the datastore kind
+	CacheLookup(kind string, hit bool)
+}
+
+var pkgMetrics atomic.Value
+
+// metricsHolder holds the metrics, as atomic.Value needs a consistent concrete type
+type metricsHolder struct {
+	Metrics
+}
+
+// SetMetrics sets the metrics of the package, such as a PrometheusMetrics. By default, or with nil,
+// nothing is measured.
+func SetMetrics(m Metrics) {
+	pkgMetrics.Store(metricsHolder{m})
+}
+
+// metrics returns the metrics of the package
+func metrics() Metrics {
+	if h, ok := pkgMetrics.Load().(metricsHolder); ok && h.Metrics != nil {
+		return h.Metrics
+	}
+	return nopMetrics{}
+}
+
+// metricsEnabled reports if metrics are set, to skip the measurements that need extra reads
+func metricsEnabled() bool {
+	_, nop := metrics().(nopMetrics)
+	return !nop
+}
+
+// outcome returns the outcome of an operation that returned err
+func outcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeOK
+}
+
+// nopMetrics drops all the measurements
+type nopMetrics struct{}
+
+func (nopMetrics) Operation(string, string, string, time.Duration) {}
+func (nopMetrics) Published(string, string, string)                {}
+func (nopMetrics) Acked(string, string, string)                    {}
+func (nopMetrics) NotificationStarted()                            {}
+func (nopMetrics) NotificationEnded(string)                        {}
+func (nopMetrics) DeviceOutcome(int, string)                       {}
+func (nopMetrics) TimeToAcknowledge(time.Duration)                 {}
+func (nopMetrics) CacheLookup(string, bool)                        {}
@@ -0,0 +1,151 @@
+package gcp
+
+//This file will contain the closing of notifications with an EvTypeEnded event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// ErrNotificationClosed is returned when adding events to a notification that already ended
+var ErrNotificationClosed = errors.New("notification is closed")
+
+// ClosePolicy has the rules to close notifications automatically
+type ClosePolicy struct {
+	// MaxLifetime closes the notification as expired when it is older. Zero means no limit
+	MaxLifetime time.Duration
+}
+
+// NotificationClose writes the EvTypeEnded event of the notification with the reason as its subtype
+// (EvSubTypeAcknowledged, EvSubTypeAllFailed, EvSubTypeCancelled, EvSubTypeExpired, ...).
+// No more events are accepted for the notification afterwards. Of concurrent closes, only the first
+// one succeeds, the others return ErrNotificationClosed.
+func NotificationClose(ctx context.Context, client *datastore.Client, ntID, reason string) (err error) {
+	ctx, span := startSpan(ctx, "NotificationClose", dst.KindEvents, "ntID = "+ntID)
+	defer func() { endSpan(span, noCount, err) }()
+	logger().InfoContext(ctx, "closing notification", LogKeyOp, "NotificationClose", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, ntID, "reason", reason)
+	nk, err := groupedNotificationKey(ctx, client, ntID)
+	if err != nil {
+		return err
+	}
+	_, err = eventPutOpen(ctx, client, &dst.Event{
+		NtID:          ntID,
+		Visibility:    VisibilityAll,
+		EvType:        EvTypeEnded,
+		EvSubType:     reason,
+		EvDescription: "notification closed: " + reason,
+	}, nk)
+	if err != nil {
+		return err
+	}
+	metrics().NotificationEnded(reason)
+	if reason == EvSubTypeAcknowledged && metricsEnabled() {
+		nts, err := NotificationGetByNtID(ctx, client, ntID)
+		if err == nil && len(nts) > 0 {
+			metrics().TimeToAcknowledge(time.Since(nts[0].Created))
+		}
+	}
+	return nil
+}
+
+// NotificationClosed reports if the notification has an EvTypeEnded event
+func NotificationClosed(ctx context.Context, client *datastore.Client, ntID string) (result bool, err error) {
+	ctx, span := startSpan(ctx, "NotificationClosed", dst.KindEvents, "ntID = "+ntID)
+	defer func() { endSpan(span, noCount, err) }()
+	nk, err := groupedNotificationKey(ctx, client, ntID)
+	if err != nil {
+		return false, err
+	}
+	return notificationClosed(ctx, client, ntID, nk)
+}
+
+// notificationClosed reports if the notification has an EvTypeEnded event, nk is its grouped key or nil
+func notificationClosed(ctx context.Context, client *datastore.Client, ntID string, nk *datastore.Key) (bool, error) {
+	query := eventsQuery(ctx, ntID, nk).Filter("evType =", EvTypeEnded).KeysOnly()
+	keys, err := client.GetAll(ctx, query, nil)
+	if err != nil {
+		return false, err
+	}
+	return len(keys) > 0, nil
+}
+
+// NotificationCheckClose applies the policy to the notification and closes it when a device replied,
+// when all its devices failed or timed out, or when it passed its maximum lifetime.
+// A notification delivered to a device stays open, waiting for a reply, until its maximum lifetime.
+// It returns the reason it was closed with, or an empty string if it is still open.
+func NotificationCheckClose(ctx context.Context, client *datastore.Client, ntID string, policy ClosePolicy, now time.Time) (result string, err error) {
+	ctx, span := startSpan(ctx, "NotificationCheckClose", dst.KindEvents, "ntID = "+ntID)
+	defer func() { endSpan(span, noCount, err) }()
+	nts, err := NotificationGetByNtID(ctx, client, ntID)
+	if err != nil {
+		return "", err
+	}
+	if len(nts) <= 0 {
+		return "", fmt.Errorf("notification not found. ntID: %s", ntID)
+	}
+	events, err := EventsGetByNtID(ctx, client, ntID)
+	if err != nil {
+		return "", err
+	}
+	reason := closeReason(events)
+	if reason == "" && policy.MaxLifetime > 0 && now.Sub(nts[0].Created) > policy.MaxLifetime {
+		reason = EvSubTypeExpired
+	}
+	if reason == "" {
+		return "", nil
+	}
+	if err = NotificationClose(ctx, client, ntID, reason); err != nil {
+		if errors.Is(err, ErrNotificationClosed) {
+			return "", nil
+		}
+		return "", err
+	}
+	return reason, nil
+}
+
+// closeReason returns the reason to close a notification from its events, or an empty string if it must stay open.
+// Being delivered is not a reason, the notification waits for a reply.
+func closeReason(events []*dst.Event) string {
+	for _, e := range events {
+		switch {
+		case e.EvType == EvTypeEnded:
+			return ""
+		case e.EvSubType == EvSubTypeReply:
+			return EvSubTypeAcknowledged
+		}
+	}
+	devices := deviceStates(events)
+	if len(devices) == 0 {
+		return ""
+	}
+	for _, state := range devices {
+		if state != EvSubTypeFailed && state != EvSubTypeTimeout {
+			// still being reached, or delivered and waiting for a reply
+			return ""
+		}
+	}
+	return EvSubTypeAllFailed
+}
+
+// deviceStates returns the last state of each device of the events: EvTypeServices while queued,
+// then the subtype of its last device event (reaching, delivered, failed, ...)
+func deviceStates(events []*dst.Event) map[string]string {
+	devices := make(map[string]string)
+	for _, e := range events {
+		switch {
+		case e.DvID == "":
+			continue
+		case e.EvType == EvTypeServices:
+			devices[e.DvID] = EvTypeServices
+		case e.EvType == EvTypeDevices:
+			devices[e.DvID] = e.EvSubType
+		}
+	}
+	return devices
+}
@@ -0,0 +1,176 @@
+package gcp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestCloseReason(t *testing.T) {
+	queued := func(dvID string) *dst.Event { return &dst.Event{DvID: dvID, EvType: EvTypeServices} }
+	device := func(dvID, subType string) *dst.Event {
+		return &dst.Event{DvID: dvID, EvType: EvTypeDevices, EvSubType: subType}
+	}
+	tests := []struct {
+		name   string
+		events []*dst.Event
+		want   string
+	}{
+		{"no devices", nil, ""},
+		{"queued", []*dst.Event{queued("dv-1")}, ""},
+		{"reaching", []*dst.Event{queued("dv-1"), device("dv-1", EvSubTypeReaching)}, ""},
+		{"delivered waits for a reply", []*dst.Event{queued("dv-1"), device("dv-1", EvSubTypeDelivered)}, ""},
+		{"delivered and failed", []*dst.Event{device("dv-1", EvSubTypeDelivered), device("dv-2", EvSubTypeFailed)}, ""},
+		{"replied", []*dst.Event{device("dv-1", EvSubTypeDelivered), device("dv-1", EvSubTypeReply)}, EvSubTypeAcknowledged},
+		{"all failed", []*dst.Event{device("dv-1", EvSubTypeFailed), device("dv-2", EvSubTypeTimeout)}, EvSubTypeAllFailed},
+		{"one still reaching", []*dst.Event{device("dv-1", EvSubTypeFailed), queued("dv-2")}, ""},
+		{"already ended", []*dst.Event{device("dv-1", EvSubTypeFailed), {EvType: EvTypeEnded}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := closeReason(tt.events); got != tt.want {
+				t.Fatalf("closeReason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationCheckCloseDelivered(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	policy := ClosePolicy{MaxLifetime: time.Hour}
+	for _, subType := range []string{EvSubTypeReaching, EvSubTypeDelivered} {
+		if _, err := EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", EvType: EvTypeDevices, EvSubType: subType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reason, err := NotificationCheckClose(ctx, client, n.NtID, policy, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "" {
+		t.Fatalf("delivered notification closed as %q, want open", reason)
+	}
+	// the device can still reply, which closes it
+	if _, err = EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", EvType: EvTypeDevices, EvSubType: EvSubTypeReply, EvDescription: "OK"}); err != nil {
+		t.Fatalf("reply to a delivered notification: %v", err)
+	}
+	if reason, err = NotificationCheckClose(ctx, client, n.NtID, policy, time.Now()); err != nil || reason != EvSubTypeAcknowledged {
+		t.Fatalf("NotificationCheckClose after reply = %q, %v; want %q", reason, err, EvSubTypeAcknowledged)
+	}
+	_, err = EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", EvType: EvTypeDevices, EvSubType: EvSubTypeReply})
+	if !errors.Is(err, ErrNotificationClosed) {
+		t.Fatalf("EventAdd after close = %v, want ErrNotificationClosed", err)
+	}
+}
+
+func TestNotificationCheckCloseExpired(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	policy := ClosePolicy{MaxLifetime: time.Hour}
+	if _, err := EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", EvType: EvTypeDevices, EvSubType: EvSubTypeDelivered}); err != nil {
+		t.Fatal(err)
+	}
+	reason, err := NotificationCheckClose(ctx, client, n.NtID, policy, n.Created.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != EvSubTypeExpired {
+		t.Fatalf("NotificationCheckClose past MaxLifetime = %q, want %q", reason, EvSubTypeExpired)
+	}
+	closed, err := NotificationClosed(ctx, client, n.NtID)
+	if err != nil || !closed {
+		t.Fatalf("NotificationClosed = %v, %v; want true", closed, err)
+	}
+}
+
+func TestNotificationCheckCloseAllFailed(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	for dvID, subType := range map[string]string{"dv-1": EvSubTypeFailed, "dv-2": EvSubTypeTimeout} {
+		if _, err := EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: dvID, EvType: EvTypeDevices, EvSubType: subType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reason, err := NotificationCheckClose(ctx, client, n.NtID, ClosePolicy{}, time.Now())
+	if err != nil || reason != EvSubTypeAllFailed {
+		t.Fatalf("NotificationCheckClose = %q, %v; want %q", reason, err, EvSubTypeAllFailed)
+	}
+}
+
+// endMetrics counts the notifications ended
+type endMetrics struct {
+	nopMetrics
+	mu    sync.Mutex
+	ended int
+}
+
+func (m *endMetrics) NotificationEnded(string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ended++
+}
+
+func TestNotificationCloseConcurrent(t *testing.T) {
+	for _, grouped := range []bool{false, true} {
+		t.Run(map[bool]string{false: "root", true: "entity group"}[grouped], func(t *testing.T) {
+			ctx, client := newTestDatastore(t)
+			if grouped {
+				SetEntityGroups(true)
+				t.Cleanup(func() { SetEntityGroups(false) })
+				if _, err := ActionAdd(SkipReferenceChecks(ctx), client, &dst.Action{AcID: "ac-1", CpID: "cp-1"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n := addTestNotification(ctx, t, client)
+			m := &endMetrics{}
+			SetMetrics(m)
+			t.Cleanup(func() { SetMetrics(nil) })
+
+			// the watchdog, an acknowledge and a cancel closing at once
+			reasons := []string{EvSubTypeExpired, EvSubTypeAcknowledged, EvSubTypeCancelled, EvSubTypeAllFailed}
+			errs := make([]error, len(reasons))
+			var wg sync.WaitGroup
+			for i, reason := range reasons {
+				wg.Add(1)
+				go func(i int, reason string) {
+					defer wg.Done()
+					errs[i] = NotificationClose(ctx, client, n.NtID, reason)
+				}(i, reason)
+			}
+			wg.Wait()
+			closed := 0
+			for _, err := range errs {
+				switch {
+				case err == nil:
+					closed++
+				case errors.Is(err, ErrNotificationClosed), errors.Is(err, datastore.ErrConcurrentTransaction):
+				default:
+					t.Fatalf("NotificationClose = %v", err)
+				}
+			}
+			events, err := EventsGetByNtID(ctx, client, n.NtID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ended := 0
+			for _, e := range events {
+				if e.EvType == EvTypeEnded {
+					ended++
+				}
+			}
+			if closed != 1 || ended != 1 || m.ended != 1 {
+				t.Fatalf("%d closes succeeded, %d ended events, %d counted; want 1 each", closed, ended, m.ended)
+			}
+			_, err = EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-1", EvType: EvTypeDevices, EvSubType: EvSubTypeReply})
+			if !errors.Is(err, ErrNotificationClosed) {
+				t.Fatalf("EventAdd after close = %v, want ErrNotificationClosed", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package gcp
+
+//This file will contain the http handler for pubsub push subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	dst "github.com/xallcloud/api/datastore"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AttrKind is the message attribute that holds the kind of entity in the message data
+const AttrKind = "kind"
+
+// Message kinds sent in the AttrKind attribute
+const (
+	MessageKindNotification = "notification"
+	MessageKindAction       = "action"
+	MessageKindEvent        = "event"
+	MessageKindCancel       = "cancel"
+)
+
+// PushMessage is the message part of a pubsub push request
+type PushMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	MessageID   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+}
+
+// PushEnvelope is the body of a pubsub push request
+type PushEnvelope struct {
+	Message      PushMessage `json:"message"`
+	Subscription string      `json:"subscription"`
+}
+
+// TokenVerifier verifies the OIDC bearer token sent by pubsub on push requests
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) error
+}
+
+// MaxPushBodyBytes is the largest push request accepted, a 10MB message encoded in base64 with its envelope
+const MaxPushBodyBytes = 16 << 20
+
+// ErrInvalidMessage is returned for a message that can never be handled, such as one of an unknown kind
+// or with data that cannot be decoded. These messages are acked, so they are not redelivered forever.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// PushHandler is an http.Handler for pubsub push subscriptions.
+// It decodes the message and dispatches it to the handler registered for its kind.
+// Returning a 2xx status acks the message, any other status nacks it so it is redelivered.
+// The errors of the registered handlers nack the message; invalid messages are acked and logged.
+// A body that is not a push envelope, or is larger than MaxPushBodyBytes, is refused with a 4xx status,
+// so it ends in the dead letter topic of the subscription, if it has one.
+type PushHandler struct {
+	verifier      TokenVerifier
+	notifications func(ctx context.Context, n *dst.Notification, m *PushMessage) error
+	actions       func(ctx context.Context, a *dst.Action, m *PushMessage) error
+	events        func(ctx context.Context, e *dst.Event, m *PushMessage) error
+	cancels       func(ctx context.Context, n *dst.Notification, m *PushMessage) error
+}
+
+// NewPushHandler returns a push handler. If verifier is nil, the bearer token is not checked.
+func NewPushHandler(verifier TokenVerifier) *PushHandler {
+	return &PushHandler{verifier: verifier}
+}
+
+// HandleNotification registers the handler for notification messages
+func (h *PushHandler) HandleNotification(f func(ctx context.Context, n *dst.Notification, m *PushMessage) error) {
+	h.notifications = f
+}
+
+// HandleAction registers the handler for action messages
+func (h *PushHandler) HandleAction(f func(ctx context.Context, a *dst.Action, m *PushMessage) error) {
+	h.actions = f
+}
+
+// HandleEvent registers the handler for event messages
+func (h *PushHandler) HandleEvent(f func(ctx context.Context, e *dst.Event, m *PushMessage) error) {
+	h.events = f
+}
+
+// HandleCancel registers the handler for the cancellation of notifications
+func (h *PushHandler) HandleCancel(f func(ctx context.Context, n *dst.Notification, m *PushMessage) error) {
+	h.cancels = f
+}
+
+// ServeHTTP decodes the push request and dispatches the message
+func (h *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	if h.verifier != nil {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		if err := h.verifier.Verify(ctx, token); err != nil {
+			logger().WarnContext(ctx, "invalid token", LogKeyOp, "PushHandler", LogKeyError, err)
+			http.Error(w, "invalid bearer token", http.StatusForbidden)
+			return
+		}
+	}
+	var env PushEnvelope
+	r.Body = http.MaxBytesReader(w, r.Body, MaxPushBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		// the subscription and the kind are in the envelope, so they are unknown
+		logger().WarnContext(ctx, "invalid push envelope", LogKeyOp, "PushHandler", "status", status, LogKeyError, err)
+		metrics().Acked("", "", OutcomeError)
+		http.Error(w, "invalid push envelope", status)
+		return
+	}
+	// continue the trace of the publisher
+	ctx, span := startSpan(ExtractTraceContext(ctx, env.Message.Attributes), "PushHandler", "subscription", env.Subscription,
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	err := h.dispatch(ctx, &env.Message)
+	endSpan(span, noCount, err)
+	if errors.Is(err, ErrInvalidMessage) {
+		logger().WarnContext(ctx, "invalid message, acked", LogKeyOp, "PushHandler", "messageID", env.Message.MessageID, "subscription", env.Subscription, LogKeyError, err)
+		err = nil
+	}
+	// replying an error status makes Pub/Sub redeliver the message, as a nack
+	metrics().Acked(env.Subscription, env.Message.Attributes[AttrKind], outcome(err))
+	if err != nil {
+		logger().ErrorContext(ctx, "message failed", LogKeyOp, "PushHandler", "messageID", env.Message.MessageID, "subscription", env.Subscription, LogKeyError, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// dispatch decodes the message data and calls the handler for its kind.
+// It returns ErrInvalidMessage when the message cannot be handled, or the error of the handler.
+func (h *PushHandler) dispatch(ctx context.Context, m *PushMessage) error {
+	switch kind := m.Attributes[AttrKind]; {
+	case kind == MessageKindNotification && h.notifications != nil:
+		n := &dst.Notification{}
+		if err := json.Unmarshal(m.Data, n); err != nil {
+			return fmt.Errorf("%w. invalid notification. %v", ErrInvalidMessage, err)
+		}
+		return h.notifications(ctx, n, m)
+	case kind == MessageKindAction && h.actions != nil:
+		a := &dst.Action{}
+		if err := json.Unmarshal(m.Data, a); err != nil {
+			return fmt.Errorf("%w. invalid action. %v", ErrInvalidMessage, err)
+		}
+		return h.actions(ctx, a, m)
+	case kind == MessageKindEvent && h.events != nil:
+		e := &dst.Event{}
+		if err := json.Unmarshal(m.Data, e); err != nil {
+			return fmt.Errorf("%w. invalid event. %v", ErrInvalidMessage, err)
+		}
+		return h.events(ctx, e, m)
+	case kind == MessageKindCancel && h.cancels != nil:
+		n := &dst.Notification{}
+		if err := json.Unmarshal(m.Data, n); err != nil {
+			return fmt.Errorf("%w. invalid notification. %v", ErrInvalidMessage, err)
+		}
+		return h.cancels(ctx, n, m)
+	default:
+		return fmt.Errorf("%w. no handler for message kind '%s'", ErrInvalidMessage, kind)
+	}
+}
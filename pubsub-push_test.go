@@ -0,0 +1,125 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// pushBody returns a push request body with the data and the kind attribute
+func pushBody(t *testing.T, kind string, data []byte) string {
+	t.Helper()
+	body, err := json.Marshal(PushEnvelope{
+		Message:      PushMessage{Data: data, Attributes: map[string]string{AttrKind: kind}, MessageID: "1"},
+		Subscription: "projects/test-project/subscriptions/alarms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestPushHandlerStatus(t *testing.T) {
+	var handled *dst.Notification
+	h := NewPushHandler(nil)
+	h.HandleNotification(func(ctx context.Context, n *dst.Notification, m *PushMessage) error {
+		if n.NtID == "fail" {
+			return errors.New("datastore unavailable")
+		}
+		handled = n
+		return nil
+	})
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantNtID   string
+	}{
+		{"handled", pushBody(t, MessageKindNotification, []byte(`{"NtID": "nt-1"}`)), http.StatusNoContent, "nt-1"},
+		{"handler error is nacked", pushBody(t, MessageKindNotification, []byte(`{"NtID": "fail"}`)), http.StatusInternalServerError, ""},
+		{"undecodable data is acked", pushBody(t, MessageKindNotification, []byte(`not json`)), http.StatusNoContent, ""},
+		{"unknown kind is acked", pushBody(t, "unknown", []byte(`{}`)), http.StatusNoContent, ""},
+		{"kind without handler is acked", pushBody(t, MessageKindAction, []byte(`{}`)), http.StatusNoContent, ""},
+		{"invalid envelope is refused", `{"message": `, http.StatusBadRequest, ""},
+		{"too large is refused", `{"message": {"data": "` + strings.Repeat("A", MaxPushBodyBytes) + `"}}`, http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = nil
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantNtID != "" && (handled == nil || handled.NtID != tt.wantNtID) {
+				t.Fatalf("handled = %+v, want ntID %s", handled, tt.wantNtID)
+			}
+		})
+	}
+}
+
+// staticVerifier accepts a single token
+type staticVerifier string
+
+func (v staticVerifier) Verify(ctx context.Context, token string) error {
+	if token != string(v) {
+		return errors.New("unknown token")
+	}
+	return nil
+}
+
+func TestPushHandlerToken(t *testing.T) {
+	h := NewPushHandler(staticVerifier("good"))
+	h.HandleEvent(func(ctx context.Context, e *dst.Event, m *PushMessage) error { return nil })
+	body := pushBody(t, MessageKindEvent, []byte(`{}`))
+	for header, want := range map[string]int{
+		"":            http.StatusUnauthorized,
+		"Bearer":      http.StatusUnauthorized,
+		"Basic good":  http.StatusUnauthorized,
+		"Bearer bad":  http.StatusForbidden,
+		"Bearer good": http.StatusNoContent,
+		"bearer good": http.StatusNoContent,
+		"BEARER good": http.StatusNoContent,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(body))
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("Authorization %q: status = %d, want %d", header, rec.Code, want)
+		}
+	}
+}
+
+// ackMetrics records the outcomes of the messages received
+type ackMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	outcomes map[string]int
+}
+
+func (m *ackMetrics) Acked(subscription, kind, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outcomes[outcome]++
+}
+
+func TestPushHandlerInvalidEnvelopeCounted(t *testing.T) {
+	m := &ackMetrics{outcomes: make(map[string]int)}
+	SetMetrics(m)
+	t.Cleanup(func() { SetMetrics(nil) })
+	rec := httptest.NewRecorder()
+	NewPushHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("not json")))
+	if rec.Code != http.StatusBadRequest || m.outcomes[OutcomeError] != 1 {
+		t.Fatalf("status = %d, outcomes %v; want 400 counted as an error", rec.Code, m.outcomes)
+	}
+}
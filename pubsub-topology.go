@@ -0,0 +1,380 @@
+package gcp
+
+//This file will contain the declarative provisioning of pubsub topics and subscriptions
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+	"gopkg.in/yaml.v2"
+)
+
+// Topology changes actions
+const (
+	TopologyCreate  = "create"
+	TopologyUpdate  = "update"
+	TopologyReplace = "replace"
+	TopologyDelete  = "delete"
+)
+
+// Topology describes all topics and subscriptions a service needs
+type Topology struct {
+	Topics        []TopicSpec        `json:"topics" yaml:"topics"`
+	Subscriptions []SubscriptionSpec `json:"subscriptions" yaml:"subscriptions"`
+	// Prune deletes the topics of the project and the subscriptions attached to the declared topics that are not declared
+	Prune bool `json:"prune" yaml:"prune"`
+}
+
+// TopicSpec describes a single topic
+type TopicSpec struct {
+	Name   string            `json:"name" yaml:"name"`
+	Labels map[string]string `json:"labels" yaml:"labels"`
+}
+
+// SubscriptionSpec describes a single subscription
+type SubscriptionSpec struct {
+	Name                string            `json:"name" yaml:"name"`
+	Topic               string            `json:"topic" yaml:"topic"`
+	PushEndpoint        string            `json:"pushEndpoint" yaml:"pushEndpoint"`
+	DeadLetterTopic     string            `json:"deadLetterTopic" yaml:"deadLetterTopic"`
+	MaxDeliveryAttempts int               `json:"maxDeliveryAttempts" yaml:"maxDeliveryAttempts"`
+	Labels              map[string]string `json:"labels" yaml:"labels"`
+}
+
+// TopologyChange is a single step needed to make the project match the topology
+type TopologyChange struct {
+	Action  string
+	Kind    string
+	Name    string
+	Details string
+	// Topic and Subscription are the spec applied by a create, update or replace of that kind
+	Topic        *TopicSpec
+	Subscription *SubscriptionSpec
+}
+
+// TopologyPlan is the list of changes needed to apply a topology
+type TopologyPlan struct {
+	Changes []TopologyChange
+}
+
+// String prints the plan, one change per line
+func (p *TopologyPlan) String() string {
+	if len(p.Changes) == 0 {
+		return "no changes"
+	}
+	var b strings.Builder
+	for _, c := range p.Changes {
+		fmt.Fprintf(&b, "%s %s %s", c.Action, c.Kind, c.Name)
+		if c.Details != "" {
+			fmt.Fprintf(&b, " (%s)", c.Details)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// LoadTopology reads a topology in YAML or JSON format
+func LoadTopology(r io.Reader) (*Topology, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topology. %v", err)
+	}
+	// JSON is valid YAML, so a single decoder handles both formats
+	topo := &Topology{}
+	if err = yaml.UnmarshalStrict(data, topo); err != nil {
+		return nil, fmt.Errorf("failed to parse topology. %v", err)
+	}
+	for _, s := range topo.Subscriptions {
+		if s.Name == "" || s.Topic == "" {
+			return nil, fmt.Errorf("subscription needs a name and a topic. %+v", s)
+		}
+	}
+	return topo, nil
+}
+
+// referencedTopics returns the topics used by a subscription, or as its dead letter topic, that are not declared.
+// They are created without labels.
+func (topo *Topology) referencedTopics() []TopicSpec {
+	seen := make(map[string]bool)
+	for _, ts := range topo.Topics {
+		seen[ts.Name] = true
+	}
+	var refs []TopicSpec
+	for _, ss := range topo.Subscriptions {
+		for _, name := range []string{ss.Topic, ss.DeadLetterTopic} {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				refs = append(refs, TopicSpec{Name: name})
+			}
+		}
+	}
+	return refs
+}
+
+// PlanTopology compares the topology with the existing topics and subscriptions and returns the changes needed.
+// Topics referenced by a subscription but not declared are created too.
+func PlanTopology(ctx context.Context, client *pubsub.Client, topo *Topology) (result *TopologyPlan, err error) {
+	ctx, span := startSpan(ctx, "PlanTopology", "topology", "")
+	defer func() { endSpan(span, noCount, err) }()
+	plan := &TopologyPlan{}
+	for i := range topo.Topics {
+		c, err := planTopic(ctx, client, &topo.Topics[i], true)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			plan.Changes = append(plan.Changes, *c)
+		}
+	}
+	refs := topo.referencedTopics()
+	for i := range refs {
+		c, err := planTopic(ctx, client, &refs[i], false)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			c.Details = "referenced"
+			plan.Changes = append(plan.Changes, *c)
+		}
+	}
+	declared := make(map[string]bool)
+	for i, ss := range topo.Subscriptions {
+		declared[ss.Name] = true
+		c, err := planSub(ctx, client, &topo.Subscriptions[i])
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			plan.Changes = append(plan.Changes, *c)
+		}
+	}
+	if !topo.Prune {
+		return plan, nil
+	}
+	var names []string
+	for _, ts := range topo.Topics {
+		names = append(names, ts.Name)
+	}
+	for _, ts := range refs {
+		names = append(names, ts.Name)
+	}
+	kept := make(map[string]bool)
+	for _, name := range names {
+		kept[name] = true
+		it := client.Topic(name).Subscriptions(ctx)
+		for {
+			s, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to list subscriptions of topic '%s'. %v", name, err)
+			}
+			if !declared[s.ID()] {
+				plan.Changes = append(plan.Changes, TopologyChange{Action: TopologyDelete, Kind: "subscription", Name: s.ID(), Details: "not declared"})
+			}
+		}
+	}
+	it := client.Topics(ctx)
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list topics. %v", err)
+		}
+		if !kept[t.ID()] {
+			plan.Changes = append(plan.Changes, TopologyChange{Action: TopologyDelete, Kind: "topic", Name: t.ID(), Details: "not declared"})
+		}
+	}
+	return plan, nil
+}
+
+// planTopic returns the change needed for a single topic, or nil if it is up to date.
+// The labels of an existing topic are only compared when checkLabels is set.
+func planTopic(ctx context.Context, client *pubsub.Client, ts *TopicSpec, checkLabels bool) (*TopologyChange, error) {
+	t := client.Topic(ts.Name)
+	exists, err := t.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check topic '%s'. %v", ts.Name, err)
+	}
+	if !exists {
+		return &TopologyChange{Action: TopologyCreate, Kind: "topic", Name: ts.Name, Topic: ts}, nil
+	}
+	if !checkLabels {
+		return nil, nil
+	}
+	cfg, err := t.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topic '%s' config. %v", ts.Name, err)
+	}
+	if sameLabels(cfg.Labels, ts.Labels) {
+		return nil, nil
+	}
+	return &TopologyChange{Action: TopologyUpdate, Kind: "topic", Name: ts.Name, Details: "labels", Topic: ts}, nil
+}
+
+// planSub returns the change needed for a single subscription, or nil if it is up to date
+func planSub(ctx context.Context, client *pubsub.Client, ss *SubscriptionSpec) (*TopologyChange, error) {
+	sub, err := GetSubContext(ctx, client, ss.Name)
+	if err != nil {
+		return nil, err
+	}
+	change := &TopologyChange{Kind: "subscription", Name: ss.Name, Subscription: ss}
+	if sub == nil {
+		change.Action = TopologyCreate
+		return change, nil
+	}
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription '%s' config. %v", ss.Name, err)
+	}
+	if cfg.Topic == nil || cfg.Topic.String() != client.Topic(ss.Topic).String() {
+		change.Action = TopologyReplace
+		change.Details = "topic"
+		return change, nil
+	}
+	var diff []string
+	if cfg.PushConfig.Endpoint != ss.PushEndpoint {
+		diff = append(diff, "pushEndpoint")
+	}
+	if !reflect.DeepEqual(cfg.DeadLetterPolicy, deadLetterPolicy(client, ss)) {
+		diff = append(diff, "deadLetter")
+	}
+	if !sameLabels(cfg.Labels, ss.Labels) {
+		diff = append(diff, "labels")
+	}
+	if len(diff) == 0 {
+		return nil, nil
+	}
+	change.Action = TopologyUpdate
+	change.Details = strings.Join(diff, ",")
+	return change, nil
+}
+
+// ApplyTopology creates, updates and deletes topics and subscriptions so the project matches the topology.
+// It is idempotent and returns the plan that was applied.
+func ApplyTopology(ctx context.Context, client *pubsub.Client, topo *Topology) (result *TopologyPlan, err error) {
+	ctx, span := startSpan(ctx, "ApplyTopology", "topology", "")
+	defer func() { endSpan(span, noCount, err) }()
+	plan, err := PlanTopology(ctx, client, topo)
+	if err != nil {
+		return nil, err
+	}
+	if err = ApplyTopologyPlan(ctx, client, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// ApplyTopologyPlan applies the changes of a plan, such as one returned by PlanTopology and filtered by the caller.
+// Topics are created first and deleted last, so subscriptions and dead letter links can be attached to them.
+func ApplyTopologyPlan(ctx context.Context, client *pubsub.Client, plan *TopologyPlan) (err error) {
+	ctx, span := startSpan(ctx, "ApplyTopologyPlan", "topology", "")
+	defer func() { endSpan(span, len(plan.Changes), err) }()
+	for _, step := range []func(c *TopologyChange) bool{
+		func(c *TopologyChange) bool { return c.Kind == "topic" && c.Action != TopologyDelete },
+		func(c *TopologyChange) bool { return c.Kind == "subscription" },
+		func(c *TopologyChange) bool { return c.Kind == "topic" && c.Action == TopologyDelete },
+	} {
+		for i := range plan.Changes {
+			if c := &plan.Changes[i]; step(c) {
+				if err = applyChange(ctx, client, c); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applyChange applies a single change of a plan
+func applyChange(ctx context.Context, client *pubsub.Client, c *TopologyChange) error {
+	logger().InfoContext(ctx, "topology change", LogKeyOp, "ApplyTopology", "action", c.Action, LogKeyKind, c.Kind, "name", c.Name)
+	switch {
+	case c.Kind == "topic" && c.Action == TopologyDelete:
+		return DeleteTopic(ctx, client, c.Name)
+	case c.Kind == "subscription" && c.Action == TopologyDelete:
+		return DeleteSubscriptionContext(ctx, client, c.Name)
+	case c.Kind == "topic" && c.Topic != nil:
+		t, err := CreateTopicContext(ctx, c.Name, client)
+		if err != nil {
+			return err
+		}
+		if len(c.Topic.Labels) > 0 || c.Action == TopologyUpdate {
+			if _, err = t.Update(ctx, pubsub.TopicConfigToUpdate{Labels: c.Topic.Labels}); err != nil {
+				return fmt.Errorf("failed to update topic '%s'. %v", c.Name, err)
+			}
+		}
+		return nil
+	case c.Kind == "subscription" && c.Subscription != nil:
+		return applySub(ctx, client, c.Subscription, c.Action == TopologyReplace)
+	}
+	return fmt.Errorf("cannot %s %s '%s' without its spec", c.Action, c.Kind, c.Name)
+}
+
+// applySub creates the subscription if needed and updates its settings to match the spec
+func applySub(ctx context.Context, client *pubsub.Client, ss *SubscriptionSpec, replace bool) error {
+	topic := client.Topic(ss.Topic)
+	var sub *pubsub.Subscription
+	var err error
+	if replace {
+		sub, err = RecreateSubContext(ctx, client, ss.Name, topic)
+	} else {
+		sub, err = CreateSubContext(ctx, client, ss.Name, topic)
+	}
+	if err != nil {
+		return err
+	}
+	upd := pubsub.SubscriptionConfigToUpdate{
+		PushConfig: &pubsub.PushConfig{Endpoint: ss.PushEndpoint},
+		Labels:     ss.Labels,
+	}
+	if dl := deadLetterPolicy(client, ss); dl != nil {
+		upd.DeadLetterPolicy = dl
+	} else {
+		// an empty policy removes the dead letter link
+		upd.DeadLetterPolicy = &pubsub.DeadLetterPolicy{}
+	}
+	if upd.Labels == nil {
+		upd.Labels = map[string]string{}
+	}
+	if _, err = sub.Update(ctx, upd); err != nil {
+		return fmt.Errorf("failed to update subscription '%s'. %v", ss.Name, err)
+	}
+	return nil
+}
+
+// deadLetterPolicy returns the pubsub dead letter policy of the spec, or nil if it has none
+func deadLetterPolicy(client *pubsub.Client, ss *SubscriptionSpec) *pubsub.DeadLetterPolicy {
+	if ss.DeadLetterTopic == "" {
+		return nil
+	}
+	attempts := ss.MaxDeliveryAttempts
+	if attempts == 0 {
+		attempts = 5
+	}
+	return &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     client.Topic(ss.DeadLetterTopic).String(),
+		MaxDeliveryAttempts: attempts,
+	}
+}
+
+// sameLabels compares two label sets, treating nil and empty as equal
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package gcp
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLoadTopology(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			input: `
+topics:
+  - name: alarms
+    labels: {team: nurses}
+subscriptions:
+  - name: alarms-worker
+    topic: alarms
+    deadLetterTopic: alarms-dead
+    maxDeliveryAttempts: 7
+`,
+		},
+		{
+			name:  "json",
+			input: `{"topics": [{"name": "alarms", "labels": {"team": "nurses"}}], "subscriptions": [{"name": "alarms-worker", "topic": "alarms", "deadLetterTopic": "alarms-dead", "maxDeliveryAttempts": 7}]}`,
+		},
+		{
+			name:    "unknown key",
+			input:   "topics:\n  - name: alarms\n    label: {team: nurses}\n",
+			wantErr: true,
+		},
+		{
+			name:    "subscription without topic",
+			input:   "subscriptions:\n  - name: alarms-worker\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topo, err := LoadTopology(strings.NewReader(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadTopology = %+v, want error", topo)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(topo.Topics) != 1 || topo.Topics[0].Name != "alarms" || topo.Topics[0].Labels["team"] != "nurses" {
+				t.Fatalf("topics = %+v", topo.Topics)
+			}
+			if len(topo.Subscriptions) != 1 {
+				t.Fatalf("subscriptions = %+v", topo.Subscriptions)
+			}
+			s := topo.Subscriptions[0]
+			if s.Name != "alarms-worker" || s.Topic != "alarms" || s.DeadLetterTopic != "alarms-dead" || s.MaxDeliveryAttempts != 7 {
+				t.Fatalf("subscription = %+v", s)
+			}
+		})
+	}
+}
+
+func TestPlanAndApplyTopology(t *testing.T) {
+	ctx := context.Background()
+	ps := newTestPubSub(t)
+	topo := &Topology{
+		Topics: []TopicSpec{{Name: "alarms"}},
+		Subscriptions: []SubscriptionSpec{
+			{Name: "alarms-worker", Topic: "alarms", Labels: map[string]string{"team": "nurses"}},
+		},
+		Prune: true,
+	}
+	plan, err := PlanTopology(ctx, ps.Client, topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "create topic alarms\ncreate subscription alarms-worker\n"
+	if got := plan.String(); got != want {
+		t.Fatalf("plan on an empty project:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err = ApplyTopology(ctx, ps.Client, topo); err != nil {
+		t.Fatal(err)
+	}
+	// applying again changes nothing
+	plan, err = PlanTopology(ctx, ps.Client, topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plan.String(); got != "no changes" {
+		t.Fatalf("plan after apply:\n%s\nwant no changes", got)
+	}
+	// a changed label and an undeclared subscription
+	topic := ps.Client.Topic("alarms")
+	if _, err = CreateSubContext(ctx, ps.Client, "alarms-legacy", topic); err != nil {
+		t.Fatal(err)
+	}
+	topo.Subscriptions[0].Labels["team"] = "porters"
+	plan, err = PlanTopology(ctx, ps.Client, topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "update subscription alarms-worker (labels)\ndelete subscription alarms-legacy (not declared)\n"
+	if got := plan.String(); got != want {
+		t.Fatalf("plan after changes:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err = ApplyTopology(ctx, ps.Client, topo); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err := GetSubContext(ctx, ps.Client, "alarms-legacy"); err != nil || sub != nil {
+		t.Fatalf("alarms-legacy after prune = %v, %v; want nil", sub, err)
+	}
+}
+
+func TestPlanAndApplyTopologyTopics(t *testing.T) {
+	ctx := context.Background()
+	ps := newTestPubSub(t)
+	if _, err := CreateTopicContext(ctx, "legacy", ps.Client); err != nil {
+		t.Fatal(err)
+	}
+	// the subscription topic and its dead letter topic are only referenced
+	topo := &Topology{
+		Subscriptions: []SubscriptionSpec{{Name: "alarms-worker", Topic: "alarms", DeadLetterTopic: "alarms-dead"}},
+		Prune:         true,
+	}
+	plan, err := PlanTopology(ctx, ps.Client, topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "create topic alarms (referenced)\ncreate topic alarms-dead (referenced)\ncreate subscription alarms-worker\ndelete topic legacy (not declared)\n"
+	if got := plan.String(); got != want {
+		t.Fatalf("plan:\n%s\nwant:\n%s", got, want)
+	}
+	// the caller keeps the topic deletion out of the plan
+	var kept TopologyPlan
+	for _, c := range plan.Changes {
+		if c.Action != TopologyDelete {
+			kept.Changes = append(kept.Changes, c)
+		}
+	}
+	if err = ApplyTopologyPlan(ctx, ps.Client, &kept); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = PlanTopology(ctx, ps.Client, topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := plan.String(), "delete topic legacy (not declared)\n"; got != want {
+		t.Fatalf("plan after the filtered apply:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err = ApplyTopology(ctx, ps.Client, topo); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := ps.Client.Topic("legacy").Exists(ctx); err != nil || exists {
+		t.Fatalf("legacy topic after prune exists = %v, %v; want false", exists, err)
+	}
+}
+
+func TestApplyTopologyPlanWithoutSpec(t *testing.T) {
+	plan := &TopologyPlan{Changes: []TopologyChange{{Action: TopologyCreate, Kind: "subscription", Name: "alarms-worker"}}}
+	if err := ApplyTopologyPlan(context.Background(), nil, plan); err == nil {
+		t.Fatal("ApplyTopologyPlan of a create without a spec, want error")
+	}
+}
@@ -4,18 +4,28 @@ package gcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"strings"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// ErrSubTopicMismatch is returned when a subscription already exists on a different topic
+var ErrSubTopicMismatch = errors.New("subscription is attached to a different topic")
+
 //CreateTopic Creates a topic if it does not exist. Otherwise, return the current existin one.
 func CreateTopic(topic string, client *pubsub.Client) (*pubsub.Topic, error) {
-	ctx := context.Background()
+	return CreateTopicContext(context.Background(), topic, client)
+}
+
+//CreateTopicContext is the same as CreateTopic but uses the given context.
+func CreateTopicContext(ctx context.Context, topic string, client *pubsub.Client) (result *pubsub.Topic, err error) {
+	ctx, span := startSpan(ctx, "CreateTopicContext", "topic", topic)
+	defer func() { endSpan(span, noCount, err) }()
 	// Create a topic to subscribe to.
 	t := client.Topic(topic)
 	exists, err := t.Exists(ctx)
@@ -34,7 +44,13 @@ func CreateTopic(topic string, client *pubsub.Client) (*pubsub.Topic, error) {
 
 //ListSubs will return the available subscriptions
 func ListSubs(client *pubsub.Client) ([]*pubsub.Subscription, error) {
-	ctx := context.Background()
+	return ListSubsContext(context.Background(), client)
+}
+
+//ListSubsContext is the same as ListSubs but uses the given context.
+func ListSubsContext(ctx context.Context, client *pubsub.Client) (result []*pubsub.Subscription, err error) {
+	ctx, span := startSpan(ctx, "ListSubsContext", "subscription", "")
+	defer func() { endSpan(span, len(result), err) }()
 	var subs []*pubsub.Subscription
 	it := client.Subscriptions(ctx)
 	for {
@@ -50,25 +66,75 @@ func ListSubs(client *pubsub.Client) ([]*pubsub.Subscription, error) {
 	return subs, nil
 }
 
-//CreateSub Create a subscription if it does't exist
+//GetSub will return the subscription with exactly the given name, or nil if it does not exist
+func GetSub(client *pubsub.Client, subName string) (*pubsub.Subscription, error) {
+	return GetSubContext(context.Background(), client, subName)
+}
+
+//GetSubContext is the same as GetSub but uses the given context.
+func GetSubContext(ctx context.Context, client *pubsub.Client, subName string) (result *pubsub.Subscription, err error) {
+	ctx, span := startSpan(ctx, "GetSubContext", "subscription", subName)
+	defer func() { endSpan(span, noCount, err) }()
+	sub := client.Subscription(subName)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check subscription '%s'. %v", subName, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	return sub, nil
+}
+
+//CreateSub Create a subscription if it does't exist.
+//If a subscription with the same name is attached to another topic, ErrSubTopicMismatch is returned.
 func CreateSub(client *pubsub.Client, subName string, topic *pubsub.Topic) (*pubsub.Subscription, error) {
-	//first list to see if the subscription exists
-	// Get Subscriptions
-	var err error
-	var subs []*pubsub.Subscription
-	subs, err = ListSubs(client)
+	return CreateSubContext(context.Background(), client, subName, topic)
+}
+
+//CreateSubContext is the same as CreateSub but uses the given context.
+func CreateSubContext(ctx context.Context, client *pubsub.Client, subName string, topic *pubsub.Topic) (result *pubsub.Subscription, err error) {
+	ctx, span := startSpan(ctx, "CreateSubContext", "subscription", subName)
+	defer func() { endSpan(span, noCount, err) }()
+	return createSub(ctx, client, subName, topic, false)
+}
+
+//RecreateSub Create a subscription if it does't exist.
+//If a subscription with the same name is attached to another topic, it is deleted and created again on the given topic.
+func RecreateSub(client *pubsub.Client, subName string, topic *pubsub.Topic) (*pubsub.Subscription, error) {
+	return RecreateSubContext(context.Background(), client, subName, topic)
+}
+
+//RecreateSubContext is the same as RecreateSub but uses the given context.
+func RecreateSubContext(ctx context.Context, client *pubsub.Client, subName string, topic *pubsub.Topic) (result *pubsub.Subscription, err error) {
+	ctx, span := startSpan(ctx, "RecreateSubContext", "subscription", subName)
+	defer func() { endSpan(span, noCount, err) }()
+	return createSub(ctx, client, subName, topic, true)
+}
+
+func createSub(ctx context.Context, client *pubsub.Client, subName string, topic *pubsub.Topic, recreate bool) (*pubsub.Subscription, error) {
+	//first check if the subscription exists with the exact name
+	sub, err := GetSubContext(ctx, client, subName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list subscriptions. %v", err)
+		return nil, err
 	}
-	// List available subscriptions
-	for _, sub := range subs {
-		if strings.HasSuffix(sub.String(), subName) {
-			// return existing subscriptions mathcing the name
+	if sub != nil {
+		cfg, err := sub.Config(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get subscription '%s' config. %v", subName, err)
+		}
+		// return existing subscription if it is attached to the requested topic
+		if cfg.Topic != nil && cfg.Topic.String() == topic.String() {
 			return sub, nil
 		}
+		if !recreate {
+			return nil, fmt.Errorf("%w. subscription '%s' is attached to '%v'", ErrSubTopicMismatch, subName, cfg.Topic)
+		}
+		logger().WarnContext(ctx, "subscription attached to another topic, will recreate", LogKeyOp, "createSub", "subscription", subName)
+		if err = sub.Delete(ctx); err != nil {
+			return nil, fmt.Errorf("failed to delete subscription '%s'. %v", subName, err)
+		}
 	}
-	ctx := context.Background()
-	var sub *pubsub.Subscription
 	sub, err = client.CreateSubscription(ctx, subName, pubsub.SubscriptionConfig{
 		Topic:             topic,
 		RetentionDuration: 1 * time.Hour,
@@ -80,13 +146,51 @@ func CreateSub(client *pubsub.Client, subName string, topic *pubsub.Topic) (*pub
 	return sub, nil
 }
 
-//DeleteSubscription will delete the subscription
+//DeleteSubscription will delete the subscription. A subscription that does not exist is not an error.
 func DeleteSubscription(client *pubsub.Client, subName string) error {
-	ctx := context.Background()
+	return DeleteSubscriptionContext(context.Background(), client, subName)
+}
+
+//DeleteSubscriptionContext is the same as DeleteSubscription but uses the given context.
+func DeleteSubscriptionContext(ctx context.Context, client *pubsub.Client, subName string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteSubscriptionContext", "subscription", subName)
+	defer func() { endSpan(span, noCount, err) }()
 	sub := client.Subscription(subName)
-	if err := sub.Delete(ctx); err != nil {
-		return err
+	if err := sub.Delete(ctx); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete subscription '%s'. %v", subName, err)
+	}
+	logger().InfoContext(ctx, "subscription deleted", LogKeyOp, "DeleteSubscription", "subscription", subName)
+	return nil
+}
+
+//DeleteTopic will delete the topic. A topic that does not exist is not an error.
+func DeleteTopic(ctx context.Context, client *pubsub.Client, topic string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteTopic", "topic", topic)
+	defer func() { endSpan(span, noCount, err) }()
+	if err := client.Topic(topic).Delete(ctx); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete topic '%s'. %v", topic, err)
 	}
-	log.Println("Subscription deleted.")
+	logger().InfoContext(ctx, "topic deleted", LogKeyOp, "DeleteTopic", "topic", topic)
 	return nil
 }
+
+//EnsureDeleted will delete the given subscriptions and then the topic.
+//Subscriptions or topic that do not exist are not an error, so it is safe to call on every shutdown.
+func EnsureDeleted(ctx context.Context, client *pubsub.Client, topic string, subNames ...string) (err error) {
+	ctx, span := startSpan(ctx, "EnsureDeleted", "topic", topic)
+	defer func() { endSpan(span, noCount, err) }()
+	for _, subName := range subNames {
+		if err := DeleteSubscriptionContext(ctx, client, subName); err != nil {
+			return err
+		}
+	}
+	if topic == "" {
+		return nil
+	}
+	return DeleteTopic(ctx, client, topic)
+}
+
+// isNotFound reports if the error returned by the pubsub service is a NotFound
+func isNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
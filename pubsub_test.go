@@ -0,0 +1,226 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"github.com/xallcloud/gcp/gcptest"
+)
+
+// newTestPubSub starts an in-memory pubsub server that is closed when the test ends
+func newTestPubSub(t *testing.T) *gcptest.PubSub {
+	t.Helper()
+	ps, err := gcptest.NewPubSub(context.Background(), "test-project")
+	if err != nil {
+		t.Fatalf("NewPubSub: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := ps.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	return ps
+}
+
+func TestCreateSubExactName(t *testing.T) {
+	ctx := context.Background()
+	ps := newTestPubSub(t)
+	other, err := CreateTopicContext(ctx, "other", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alarms, err := CreateTopicContext(ctx, "alarms", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "old-alarms" ends with "alarms" but must not be taken for it
+	if _, err = CreateSubContext(ctx, ps.Client, "old-alarms", other); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := GetSubContext(ctx, ps.Client, "alarms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub != nil {
+		t.Fatalf("GetSub(alarms) = %v, want nil", sub)
+	}
+	sub, err = CreateSubContext(ctx, ps.Client, "alarms", alarms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.ID() != "alarms" {
+		t.Fatalf("CreateSub returned %q, want alarms", sub.ID())
+	}
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Topic.String() != alarms.String() {
+		t.Fatalf("alarms attached to %v, want %v", cfg.Topic, alarms)
+	}
+	// the existing subscription on the requested topic is returned as is
+	again, err := CreateSubContext(ctx, ps.Client, "alarms", alarms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != sub.String() {
+		t.Fatalf("CreateSub again returned %v, want %v", again, sub)
+	}
+}
+
+func TestCreateSubTopicMismatch(t *testing.T) {
+	ctx := context.Background()
+	ps := newTestPubSub(t)
+	other, err := CreateTopicContext(ctx, "other", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alarms, err := CreateTopicContext(ctx, "alarms", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateSubContext(ctx, ps.Client, "alarms", other); err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateSubContext(ctx, ps.Client, "alarms", alarms)
+	if !errors.Is(err, ErrSubTopicMismatch) {
+		t.Fatalf("CreateSub on another topic: err = %v, want ErrSubTopicMismatch", err)
+	}
+	sub, err := RecreateSubContext(ctx, ps.Client, "alarms", alarms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Topic.String() != alarms.String() {
+		t.Fatalf("recreated subscription attached to %v, want %v", cfg.Topic, alarms)
+	}
+}
+
+func TestPubSubHelpers(t *testing.T) {
+	ps := newTestPubSub(t)
+	topic, err := CreateTopic("alarms", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := CreateTopic("alarms", ps.Client); err != nil || again.String() != topic.String() {
+		t.Fatalf("CreateTopic again = %v, %v; want %v", again, err, topic)
+	}
+	if _, err = CreateSub(ps.Client, "alarms-worker", topic); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := ListSubs(ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].ID() != "alarms-worker" {
+		t.Fatalf("ListSubs = %v, want [alarms-worker]", subs)
+	}
+	if err = DeleteSubscription(ps.Client, "alarms-worker"); err != nil {
+		t.Fatal(err)
+	}
+	if subs, err = ListSubs(ps.Client); err != nil || len(subs) != 0 {
+		t.Fatalf("ListSubs after delete = %v, %v; want none", subs, err)
+	}
+	if err = DeleteSubscription(ps.Client, "alarms-worker"); err != nil {
+		t.Fatalf("DeleteSubscription of a deleted subscription = %v, want nil", err)
+	}
+	// teardown is idempotent
+	for i := 0; i < 2; i++ {
+		if err = EnsureDeleted(context.Background(), ps.Client, "alarms", "alarms-worker"); err != nil {
+			t.Fatalf("EnsureDeleted #%d: %v", i+1, err)
+		}
+	}
+}
+
+func TestPubSubRedelivery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ps := newTestPubSub(t)
+	topic, err := CreateTopicContext(ctx, "alarms", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := CreateSubContext(ctx, ps.Client, "alarms-worker", topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = topic.Publish(ctx, &pubsub.Message{Data: []byte("job")}).Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	deliveries := 0
+	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries++
+		if deliveries == 1 {
+			// the first attempt fails, the message must come back
+			m.Nack()
+			return
+		}
+		m.Ack()
+		cancel()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deliveries != 2 {
+		t.Fatalf("deliveries = %d, want 2", deliveries)
+	}
+}
+
+func TestPubSubOrdering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ps := newTestPubSub(t)
+	topic, err := CreateTopicContext(ctx, "alarms", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.EnableMessageOrdering = true
+	sub, err := ps.Client.CreateSubscription(ctx, "alarms-ordered", pubsub.SubscriptionConfig{
+		Topic:                 topic,
+		EnableMessageOrdering: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const total = 20
+	for i := 0; i < total; i++ {
+		res := topic.Publish(ctx, &pubsub.Message{Data: []byte(strconv.Itoa(i)), OrderingKey: "cp-1"})
+		if _, err = res.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	var got []string
+	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		m.Ack()
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, string(m.Data))
+		if len(got) == total {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range got {
+		if data != strconv.Itoa(i) {
+			t.Fatalf("message #%d = %s, want %d (received %v)", i, data, i, got)
+		}
+	}
+	if len(got) != total {
+		t.Fatalf("received %d messages, want %d", len(got), total)
+	}
+}
@@ -0,0 +1,148 @@
+package gcp
+
+//This file will contain the handling of replies sent by two-way devices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// ErrInvalidReply is returned when a reply is not accepted for the notification
+var ErrInvalidReply = errors.New("invalid reply")
+
+// Reply is the answer of a device to a notification
+type Reply struct {
+	NtID    string
+	DvID    string
+	Option  string
+	Created time.Time
+}
+
+// ReplyHandler validates and records the replies of two-way devices
+type ReplyHandler struct {
+	ds *datastore.Client
+}
+
+// NewReplyHandler returns a reply handler that stores the replies in the datastore
+func NewReplyHandler(ds *datastore.Client) *ReplyHandler {
+	return &ReplyHandler{ds: ds}
+}
+
+// NotificationOptions returns the reply options of the notification.
+// Options are stored either as a JSON array or as a comma separated list.
+func NotificationOptions(n *dst.Notification) []string {
+	raw := strings.TrimSpace(n.Options)
+	if raw == "" {
+		return nil
+	}
+	var options []string
+	if strings.HasPrefix(raw, "[") && json.Unmarshal([]byte(raw), &options) == nil {
+		return options
+	}
+	for _, o := range strings.Split(raw, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// Reply validates the option chosen by the device and records it as a reply event,
+// which stops further escalation of the notification.
+func (h *ReplyHandler) Reply(ctx context.Context, ntID, dvID, option string) (*Reply, error) {
+	logger().InfoContext(ctx, "reply", LogKeyOp, "Reply", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, ntID, "dvID", dvID, "option", option)
+	nts, err := NotificationGetByNtID(ctx, h.ds, ntID)
+	if err != nil {
+		return nil, err
+	}
+	if len(nts) <= 0 {
+		return nil, fmt.Errorf("%w. notification not found: %s", ErrInvalidReply, ntID)
+	}
+	dvs, err := DeviceGetByDvID(ctx, h.ds, dvID)
+	if err != nil {
+		return nil, err
+	}
+	if len(dvs) <= 0 {
+		return nil, fmt.Errorf("%w. device not found: %s", ErrInvalidReply, dvID)
+	}
+	if !dvs[0].IsTwoWay {
+		return nil, fmt.Errorf("%w. device is not two-way: %s", ErrInvalidReply, dvID)
+	}
+	events, err := EventsGetByNtID(ctx, h.ds, ntID)
+	if err != nil {
+		return nil, err
+	}
+	if !deviceTargeted(events, dvID) {
+		return nil, fmt.Errorf("%w. device %s was not sent notification %s", ErrInvalidReply, dvID, ntID)
+	}
+	option = strings.TrimSpace(option)
+	valid := false
+	for _, o := range NotificationOptions(nts[0]) {
+		if strings.EqualFold(o, option) {
+			option = o
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("%w. option '%s' not in '%s'", ErrInvalidReply, option, nts[0].Options)
+	}
+	_, err = EventAdd(ctx, h.ds, &dst.Event{
+		NtID:          ntID,
+		DvID:          dvID,
+		Visibility:    VisibilityAll,
+		EvType:        EvTypeDevices,
+		EvSubType:     EvSubTypeReply,
+		EvDescription: option,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Reply{NtID: ntID, DvID: dvID, Option: option, Created: time.Now()}, nil
+}
+
+// deviceTargeted reports if the events show the notification was queued or sent to the device
+func deviceTargeted(events []*dst.Event, dvID string) bool {
+	for _, e := range events {
+		if e.DvID == dvID && (e.EvType == EvTypeServices || e.EvType == EvTypeDevices) {
+			return true
+		}
+	}
+	return false
+}
+
+// RepliesGetByNtID will return the replies of the notification in ascending order of creation time
+func RepliesGetByNtID(ctx context.Context, client *datastore.Client, ntID string) (result []*Reply, err error) {
+	ctx, span := startSpan(ctx, "RepliesGetByNtID", dst.KindEvents, "ntID = "+ntID)
+	defer func() { endSpan(span, len(result), err) }()
+	events, err := EventsGetByNtID(ctx, client, ntID)
+	if err != nil {
+		return nil, err
+	}
+	var replies []*Reply
+	for _, e := range events {
+		if e.EvSubType == EvSubTypeReply {
+			replies = append(replies, &Reply{NtID: e.NtID, DvID: e.DvID, Option: e.EvDescription, Created: e.Created})
+		}
+	}
+	return replies, nil
+}
+
+// NotificationReplied reports if any device replied to the notification, in which case it must not be escalated
+func NotificationReplied(ctx context.Context, client *datastore.Client, ntID string) (result bool, err error) {
+	ctx, span := startSpan(ctx, "NotificationReplied", dst.KindEvents, "ntID = "+ntID)
+	defer func() { endSpan(span, noCount, err) }()
+	replies, err := RepliesGetByNtID(ctx, client, ntID)
+	if err != nil {
+		return false, err
+	}
+	return len(replies) > 0, nil
+}
@@ -0,0 +1,80 @@
+package gcp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestNotificationOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    []string
+	}{
+		{"", nil},
+		{"OK, NO ,", []string{"OK", "NO"}},
+		{`["OK", "on my way"]`, []string{"OK", "on my way"}},
+		{"[not json", []string{"[not json"}},
+	}
+	for _, tt := range tests {
+		got := NotificationOptions(&dst.Notification{Options: tt.options})
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("NotificationOptions(%q) = %q, want %q", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	for _, dv := range []*dst.Device{{DvID: "dv-1", IsTwoWay: true}, {DvID: "dv-2", IsTwoWay: true}, {DvID: "dv-pager"}} {
+		if _, err := DeviceAdd(ctx, client, dv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the notification was sent to dv-1 and dv-pager only
+	for _, dvID := range []string{"dv-1", "dv-pager"} {
+		if _, err := EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: dvID, EvType: EvTypeServices}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewReplyHandler(client)
+	for _, tc := range []struct {
+		name, ntID, dvID, option string
+	}{
+		{"unknown notification", "nt-gone", "dv-1", "OK"},
+		{"unknown device", n.NtID, "dv-gone", "OK"},
+		{"one-way device", n.NtID, "dv-pager", "OK"},
+		{"device not sent the notification", n.NtID, "dv-2", "OK"},
+		{"option not offered", n.NtID, "dv-1", "MAYBE"},
+	} {
+		if _, err := h.Reply(ctx, tc.ntID, tc.dvID, tc.option); !errors.Is(err, ErrInvalidReply) {
+			t.Errorf("%s: Reply = %v, want ErrInvalidReply", tc.name, err)
+		}
+	}
+	replied, err := NotificationReplied(ctx, client, n.NtID)
+	if err != nil || replied {
+		t.Fatalf("NotificationReplied after invalid replies = %v, %v; want false", replied, err)
+	}
+
+	// the option is matched regardless of case and spaces, and stored as offered
+	r, err := h.Reply(ctx, n.NtID, "dv-1", " ok ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Option != "OK" {
+		t.Fatalf("reply option = %q, want OK", r.Option)
+	}
+	replies, err := RepliesGetByNtID(ctx, client, n.NtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 1 || replies[0].DvID != "dv-1" || replies[0].Option != "OK" {
+		t.Fatalf("replies = %+v, want OK from dv-1", replies)
+	}
+	if replied, err = NotificationReplied(ctx, client, n.NtID); err != nil || !replied {
+		t.Fatalf("NotificationReplied = %v, %v; want true", replied, err)
+	}
+}
@@ -0,0 +1,64 @@
+package gcp
+
+//This file will contain the priority based routing of notifications
+
+import (
+	"context"
+	"encoding/json"
+
+	"cloud.google.com/go/pubsub"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// ActionPriority returns the priority requested in the action raw request ("priority" field), or 0 if none
+func ActionPriority(ac *dst.Action) int {
+	var req struct {
+		Priority int `json:"priority"`
+	}
+	if err := json.Unmarshal([]byte(ac.RawRequest), &req); err != nil {
+		return 0
+	}
+	return req.Priority
+}
+
+// NotificationPriority combines the callpoint and the action priorities into the notification priority.
+// The highest of both is used, so an action can raise the priority of its callpoint but never lower it.
+func NotificationPriority(cp *dst.Callpoint, ac *dst.Action) int {
+	p := ActionPriority(ac)
+	if cp.Priority > p {
+		return cp.Priority
+	}
+	return p
+}
+
+// DeviceAccepts reports if the device must be reached for a notification of the given priority.
+// Device.Priority is the minimum priority the device accepts.
+func DeviceAccepts(dv *dst.Device, priority int) bool {
+	return priority >= dv.Priority
+}
+
+// EnableFastLane creates the fast lane topic if needed, and makes the dispatcher publish the delivery
+// jobs of the notifications with priority equal or above minPriority to it instead of the bulk topic.
+func (d *Dispatcher) EnableFastLane(ctx context.Context, client *pubsub.Client, topic string, minPriority int) error {
+	t, err := CreateTopicContext(ctx, topic, client)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.fastLane = t
+	d.fastLanePriority = minPriority
+	d.mu.Unlock()
+	logger().InfoContext(ctx, "fast lane enabled", LogKeyOp, "EnableFastLane", "topic", topic, "minPriority", minPriority)
+	return nil
+}
+
+// topicFor returns the topic for the delivery jobs of the notification
+func (d *Dispatcher) topicFor(n *dst.Notification) *pubsub.Topic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fastLane != nil && n.Priority >= d.fastLanePriority {
+		return d.fastLane
+	}
+	return d.topic
+}
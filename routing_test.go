@@ -0,0 +1,106 @@
+package gcp
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestNotificationPriority(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		cpPriority int
+		rawRequest string
+		want       int
+	}{
+		{"callpoint only", 3, "", 3},
+		{"action raises", 1, `{"priority": 4}`, 4},
+		{"action cannot lower", 3, `{"priority": 1}`, 3},
+		{"invalid request", 2, `{"priority": "high"}`, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := NotificationPriority(&dst.Callpoint{Priority: tc.cpPriority}, &dst.Action{RawRequest: tc.rawRequest})
+			if got != tc.want {
+				t.Fatalf("NotificationPriority = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReachable(t *testing.T) {
+	assignments := []*dst.Assignment{
+		{AsID: "as-1", DvID: "dv-1", DeviceObj: dst.Device{DvID: "dv-1", Priority: 0}},
+		{AsID: "as-2", DvID: "dv-2", DeviceObj: dst.Device{DvID: "dv-2", Priority: 3}},
+		{AsID: "as-3", DvID: "dv-3", DeviceObj: dst.Device{DvID: "dv-3", Priority: 5}},
+		{AsID: "as-4", DvID: "dv-gone"},
+	}
+	for _, tc := range []struct {
+		priority int
+		want     []string
+	}{
+		{0, []string{"dv-1"}},
+		{3, []string{"dv-1", "dv-2"}},
+		{9, []string{"dv-1", "dv-2", "dv-3"}},
+	} {
+		got := reachable(context.Background(), assignments, tc.priority)
+		var dvIDs []string
+		for _, a := range got {
+			dvIDs = append(dvIDs, a.DvID)
+		}
+		if len(dvIDs) != len(tc.want) {
+			t.Fatalf("reachable at priority %d = %v, want %v", tc.priority, dvIDs, tc.want)
+		}
+		for i := range dvIDs {
+			if dvIDs[i] != tc.want[i] {
+				t.Fatalf("reachable at priority %d = %v, want %v", tc.priority, dvIDs, tc.want)
+			}
+		}
+	}
+}
+
+func TestTopicFor(t *testing.T) {
+	bulk, fast := &pubsub.Topic{}, &pubsub.Topic{}
+	d := &Dispatcher{topic: bulk, clock: systemClock{}}
+	if d.topicFor(&dst.Notification{Priority: 9}) != bulk {
+		t.Fatal("without fast lane, want the bulk topic")
+	}
+	d.fastLane, d.fastLanePriority = fast, 5
+	for priority, want := range map[int]*pubsub.Topic{4: bulk, 5: fast, 9: fast} {
+		if d.topicFor(&dst.Notification{Priority: priority}) != want {
+			t.Errorf("topicFor priority %d is not the expected topic", priority)
+		}
+	}
+}
+
+func TestEnableFastLane(t *testing.T) {
+	ctx := context.Background()
+	ps := newTestPubSub(t)
+	bulk, err := CreateTopicContext(ctx, "jobs", ps.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(nil, bulk)
+	// dispatching while the fast lane is enabled must not race
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			d.topicFor(&dst.Notification{Priority: 5})
+		}
+	}()
+	if err = d.EnableFastLane(ctx, ps.Client, "jobs-fast", 5); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if got := d.topicFor(&dst.Notification{Priority: 5}).ID(); got != "jobs-fast" {
+		t.Fatalf("topicFor priority 5 = %s, want jobs-fast", got)
+	}
+	if got := d.topicFor(&dst.Notification{Priority: 4}).ID(); got != "jobs" {
+		t.Fatalf("topicFor priority 4 = %s, want jobs", got)
+	}
+}
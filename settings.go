@@ -0,0 +1,167 @@
+package gcp
+
+//This file will contain the typed settings of each device type and of the assignments
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// SettingsValidator is implemented by settings structs that check their own values
+type SettingsValidator interface {
+	Validate() error
+}
+
+// settingsKey identifies a registered settings struct: the device type for devices, 0 for assignments
+type settingsKey struct {
+	kind   string
+	dvType int
+}
+
+var (
+	settingsMu       sync.RWMutex
+	settingsDefaults = make(map[settingsKey]interface{})
+)
+
+// RegisterDeviceSettings sets the settings struct of a device type. defaults is a struct value:
+// its type is the schema of Device.Settings and its fields are the default values.
+// If the struct implements SettingsValidator, it is called when the settings are validated.
+func RegisterDeviceSettings(dvType int, defaults interface{}) {
+	if reflect.TypeOf(defaults).Kind() != reflect.Struct {
+		panic(fmt.Sprintf("device settings of type %d must be a struct, got %T", dvType, defaults))
+	}
+	registerSettings(settingsKey{kind: dst.KindDevices, dvType: dvType}, defaults)
+}
+
+// RegisterAssignmentSettings sets the settings struct of the assignments, as RegisterDeviceSettings
+// does for a device type. It is the schema of Assignment.Settings, with its default values.
+func RegisterAssignmentSettings(defaults interface{}) {
+	if reflect.TypeOf(defaults).Kind() != reflect.Struct {
+		panic(fmt.Sprintf("assignment settings must be a struct, got %T", defaults))
+	}
+	registerSettings(settingsKey{kind: dst.KindAssignments}, defaults)
+}
+
+// registerSettings stores the defaults of the settings
+func registerSettings(key settingsKey, defaults interface{}) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settingsDefaults[key] = defaults
+}
+
+// registeredDefaults returns the registered defaults of the settings
+func registeredDefaults(key settingsKey) (interface{}, bool) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	def, ok := settingsDefaults[key]
+	return def, ok
+}
+
+// DeviceSettingsAs decodes the device settings into T, starting from the defaults registered
+// for the device type when they are of type T. Fields of the settings not in T are ignored,
+// so T can also be a partial view of the settings.
+func DeviceSettingsAs[T any](dv *dst.Device) (*T, error) {
+	return settingsAs[T](settingsKey{kind: dst.KindDevices, dvType: dv.Type}, dv.Settings)
+}
+
+// AssignmentSettingsAs decodes the assignment settings into T, as DeviceSettingsAs
+func AssignmentSettingsAs[T any](asgn *dst.Assignment) (*T, error) {
+	return settingsAs[T](settingsKey{kind: dst.KindAssignments}, asgn.Settings)
+}
+
+// settingsAs decodes the settings into T, starting from the registered defaults when they are of type T
+func settingsAs[T any](key settingsKey, settings string) (*T, error) {
+	s := new(T)
+	if def, ok := registeredDefaults(key); ok {
+		if d, ok := def.(T); ok {
+			*s = d
+		}
+	}
+	if err := decodeSettings(settings, s, false); err != nil {
+		return nil, err
+	}
+	if v, ok := interface{}(s).(SettingsValidator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// registeredSettings decodes the settings into a new value of the registered struct.
+// It returns nil when no settings are registered for the key.
+func registeredSettings(key settingsKey, settings string) (interface{}, error) {
+	def, ok := registeredDefaults(key)
+	if !ok {
+		return nil, nil
+	}
+	s := reflect.New(reflect.TypeOf(def))
+	s.Elem().Set(reflect.ValueOf(def))
+	if err := decodeSettings(settings, s.Interface(), true); err != nil {
+		return nil, err
+	}
+	if v, ok := s.Interface().(SettingsValidator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return s.Interface(), nil
+}
+
+// defaultSettings returns the settings with the registered defaults filled in, unchanged without registered settings
+func defaultSettings(key settingsKey, settings string) (string, error) {
+	s, err := registeredSettings(key, settings)
+	if err != nil || s == nil {
+		return settings, err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// ValidateDeviceSettings checks the device settings against the struct registered for its type
+func ValidateDeviceSettings(dv *dst.Device) error {
+	_, err := registeredSettings(settingsKey{kind: dst.KindDevices, dvType: dv.Type}, dv.Settings)
+	return err
+}
+
+// DefaultDeviceSettings returns the device settings with the defaults of its type filled in.
+// Devices of a type without registered settings are returned unchanged.
+func DefaultDeviceSettings(dv *dst.Device) (string, error) {
+	return defaultSettings(settingsKey{kind: dst.KindDevices, dvType: dv.Type}, dv.Settings)
+}
+
+// ValidateAssignmentSettings checks the assignment settings against the registered struct
+func ValidateAssignmentSettings(asgn *dst.Assignment) error {
+	_, err := registeredSettings(settingsKey{kind: dst.KindAssignments}, asgn.Settings)
+	return err
+}
+
+// DefaultAssignmentSettings returns the assignment settings with the registered defaults filled in.
+// Without registered assignment settings they are returned unchanged.
+func DefaultAssignmentSettings(asgn *dst.Assignment) (string, error) {
+	return defaultSettings(settingsKey{kind: dst.KindAssignments}, asgn.Settings)
+}
+
+// decodeSettings decodes the JSON settings. When strict, unknown fields are refused
+func decodeSettings(settings string, s interface{}, strict bool) error {
+	if strings.TrimSpace(settings) == "" {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(settings)))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(s); err != nil {
+		return fmt.Errorf("invalid settings. %v", err)
+	}
+	return nil
+}
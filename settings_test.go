@@ -0,0 +1,86 @@
+package gcp
+
+import (
+	"errors"
+	"testing"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// escalationSettings are assignment settings with a default and a validation
+type escalationSettings struct {
+	DelaySeconds int  `json:"delaySeconds"`
+	Silent       bool `json:"silent"`
+}
+
+func (s *escalationSettings) Validate() error {
+	if s.DelaySeconds < 0 {
+		return errors.New("delaySeconds must not be negative")
+	}
+	return nil
+}
+
+// registerTestSettings registers the settings until the test ends
+func registerTestSettings(t *testing.T, key settingsKey, defaults interface{}) {
+	t.Helper()
+	registerSettings(key, defaults)
+	t.Cleanup(func() {
+		settingsMu.Lock()
+		defer settingsMu.Unlock()
+		delete(settingsDefaults, key)
+	})
+}
+
+func TestAssignmentSettings(t *testing.T) {
+	asgn := &dst.Assignment{AsID: "as-1", Settings: `{"silent": true}`}
+	// without registered settings, any JSON is accepted as is
+	if got, err := DefaultAssignmentSettings(asgn); err != nil || got != asgn.Settings {
+		t.Fatalf("DefaultAssignmentSettings unregistered = %q, %v", got, err)
+	}
+	registerTestSettings(t, settingsKey{kind: dst.KindAssignments}, escalationSettings{DelaySeconds: 60})
+
+	got, err := DefaultAssignmentSettings(asgn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"delaySeconds":60,"silent":true}`; got != want {
+		t.Fatalf("DefaultAssignmentSettings = %s, want %s", got, want)
+	}
+	s, err := AssignmentSettingsAs[escalationSettings](asgn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.DelaySeconds != 60 || !s.Silent {
+		t.Fatalf("AssignmentSettingsAs = %+v", s)
+	}
+	for settings, wantErr := range map[string]bool{
+		``:                      false,
+		`{"delaySeconds": 5}`:   false,
+		`{"delay": 5}`:          true,
+		`{"delaySeconds": -5}`:  true,
+		`{"delaySeconds": "5"}`: true,
+	} {
+		err := ValidateAssignmentSettings(&dst.Assignment{Settings: settings})
+		if (err != nil) != wantErr {
+			t.Errorf("ValidateAssignmentSettings(%s) = %v, wantErr %v", settings, err, wantErr)
+		}
+	}
+}
+
+func TestDeviceSettingsByType(t *testing.T) {
+	registerTestSettings(t, settingsKey{kind: dst.KindDevices, dvType: 7}, timeoutSettings{TimeoutSeconds: 45})
+	got, err := DefaultDeviceSettings(&dst.Device{Type: 7})
+	if err != nil || got != `{"timeoutSeconds":45}` {
+		t.Fatalf("DefaultDeviceSettings = %s, %v", got, err)
+	}
+	// the assignment and the other device types are not affected
+	if err = ValidateDeviceSettings(&dst.Device{Type: 8, Settings: `{"any": 1}`}); err != nil {
+		t.Fatalf("unregistered device type: %v", err)
+	}
+	if err = ValidateAssignmentSettings(&dst.Assignment{Settings: `{"any": 1}`}); err != nil {
+		t.Fatalf("unregistered assignment settings: %v", err)
+	}
+	if err = ValidateDeviceSettings(&dst.Device{Type: 7, Settings: `{"any": 1}`}); err == nil {
+		t.Fatal("unknown field accepted for a registered device type")
+	}
+}
@@ -0,0 +1,165 @@
+package gcp
+
+//This file will contain the suppression of repeated actions on the same callpoint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// SuppressionStats counts the actions dispatched and suppressed
+type SuppressionStats struct {
+	Dispatched int
+	Suppressed int
+	// ByCallpoint has the number of actions suppressed for each callpoint
+	ByCallpoint map[TenantCallpoint]int
+}
+
+// TenantCallpoint identifies a callpoint, since callpoints of different tenants can have the same cpID
+type TenantCallpoint struct {
+	Tenant string
+	CpID   string
+}
+
+// Suppressor dispatches actions, coalescing the actions of the same callpoint that arrive within
+// the window into the notification that is still open, instead of creating a new one for each.
+type Suppressor struct {
+	d      *Dispatcher
+	window time.Duration
+	clock  Clock
+
+	mu    sync.Mutex
+	open  map[TenantCallpoint]*openNotification
+	locks map[TenantCallpoint]*callpointLock
+	stats SuppressionStats
+}
+
+// callpointLock serializes the actions of a callpoint, so the suppressor lock is not held during I/O
+type callpointLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// openNotification is the last notification dispatched for a callpoint
+type openNotification struct {
+	handle     *DispatchHandle
+	started    time.Time
+	suppressed int
+}
+
+// NewSuppressor returns a suppressor that coalesces the actions of a callpoint within the window
+func NewSuppressor(d *Dispatcher, window time.Duration) *Suppressor {
+	return &Suppressor{
+		d:      d,
+		window: window,
+		clock:  systemClock{},
+		open:   make(map[TenantCallpoint]*openNotification),
+		locks:  make(map[TenantCallpoint]*callpointLock),
+		stats:  SuppressionStats{ByCallpoint: make(map[TenantCallpoint]int)},
+	}
+}
+
+// SetClock replaces the clock used for the window
+func (s *Suppressor) SetClock(c Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+}
+
+// Dispatch dispatches the action, unless its callpoint has an open notification started within the window.
+// In that case the suppressed count is recorded as a server event and the open notification handle is returned.
+// Actions of the same callpoint are handled one at a time, actions of different callpoints concurrently.
+func (s *Suppressor) Dispatch(ctx context.Context, ac *dst.Action) (h *DispatchHandle, suppressed bool, err error) {
+	key := TenantCallpoint{Tenant: TenantFromContext(ctx), CpID: ac.CpID}
+	defer s.lock(key)()
+	s.mu.Lock()
+	now := s.clock.Now()
+	o, ok := s.open[key]
+	s.mu.Unlock()
+	if ok && now.Sub(o.started) < s.window {
+		closed, err := NotificationClosed(ctx, s.d.ds, o.handle.NtID)
+		if err != nil {
+			return nil, false, err
+		}
+		if !closed {
+			s.mu.Lock()
+			o.suppressed++
+			count := o.suppressed
+			s.stats.Suppressed++
+			s.stats.ByCallpoint[key]++
+			s.mu.Unlock()
+			logger().InfoContext(ctx, "action coalesced", LogKeyOp, "Suppressor", LogKeyKind, dst.KindActions, LogKeyBusinessID, ac.AcID, "ntID", o.handle.NtID)
+			_, err = EventAdd(ctx, s.d.ds, &dst.Event{
+				NtID:          o.handle.NtID,
+				CpID:          ac.CpID,
+				Visibility:    VisibilityServer,
+				EvType:        EvTypeServices,
+				EvSubType:     EvSubTypeSuppressed,
+				EvDescription: fmt.Sprintf("action %s suppressed, %d suppressed so far", ac.AcID, count),
+			})
+			if err != nil {
+				return nil, false, err
+			}
+			return o.handle, true, nil
+		}
+	}
+	h, err = s.d.Dispatch(ctx, ac)
+	if err != nil {
+		return nil, false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open[key] = &openNotification{handle: h, started: now}
+	s.stats.Dispatched++
+	s.expire(now)
+	return h, false, nil
+}
+
+// lock locks the callpoint and returns the function that unlocks it
+func (s *Suppressor) lock(key TenantCallpoint) func() {
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &callpointLock{}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, key)
+		}
+	}
+}
+
+// expire forgets the notifications older than the window. Must be called with the lock held
+func (s *Suppressor) expire(now time.Time) {
+	for key, o := range s.open {
+		if now.Sub(o.started) >= s.window {
+			delete(s.open, key)
+		}
+	}
+}
+
+// Stats returns a copy of the suppression statistics
+func (s *Suppressor) Stats() SuppressionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := SuppressionStats{
+		Dispatched:  s.stats.Dispatched,
+		Suppressed:  s.stats.Suppressed,
+		ByCallpoint: make(map[TenantCallpoint]int, len(s.stats.ByCallpoint)),
+	}
+	for key, n := range s.stats.ByCallpoint {
+		stats.ByCallpoint[key] = n
+	}
+	return stats
+}
@@ -0,0 +1,148 @@
+package gcp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// suppressedEvents counts the suppressed events of the notification
+func suppressedEvents(ctx context.Context, t *testing.T, h *DispatchHandle) int {
+	t.Helper()
+	s, err := h.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, e := range s.Events {
+		if e.EvSubType == EvSubTypeSuppressed {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSuppressorCoalesces(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, _ := newTestDispatcher(ctx, t, client)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+	s := NewSuppressor(d, time.Minute)
+	clock := newFakeClock()
+	s.SetClock(clock)
+
+	first, suppressed, err := s.Dispatch(ctx, ac)
+	if err != nil || suppressed {
+		t.Fatalf("first Dispatch = %v, %v; want dispatched", suppressed, err)
+	}
+	clock.Advance(30 * time.Second)
+	h, suppressed, err := s.Dispatch(ctx, ac)
+	if err != nil || !suppressed || h.NtID != first.NtID {
+		t.Fatalf("Dispatch within the window = %+v, %v, %v; want %s suppressed", h, suppressed, err, first.NtID)
+	}
+	if got := suppressedEvents(ctx, t, first); got != 1 {
+		t.Fatalf("suppressed events = %d, want 1", got)
+	}
+	// the window starts with the dispatched notification, not with the last suppressed action
+	clock.Advance(31 * time.Second)
+	h, suppressed, err = s.Dispatch(ctx, ac)
+	if err != nil || suppressed || h.NtID == first.NtID {
+		t.Fatalf("Dispatch after the window = %+v, %v, %v; want a new notification", h, suppressed, err)
+	}
+	stats := s.Stats()
+	key := TenantCallpoint{Tenant: TenantFromContext(ctx), CpID: "cp-1"}
+	if stats.Dispatched != 2 || stats.Suppressed != 1 || stats.ByCallpoint[key] != 1 {
+		t.Fatalf("stats = %+v, want 2 dispatched and 1 suppressed on cp-1", stats)
+	}
+}
+
+func TestSuppressorAfterClose(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, _ := newTestDispatcher(ctx, t, client)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+	s := NewSuppressor(d, time.Hour)
+
+	first, _, err := s.Dispatch(ctx, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = NotificationClose(ctx, client, first.NtID, EvSubTypeAcknowledged); err != nil {
+		t.Fatal(err)
+	}
+	h, suppressed, err := s.Dispatch(ctx, ac)
+	if err != nil || suppressed || h.NtID == first.NtID {
+		t.Fatalf("Dispatch after close = %+v, %v, %v; want a new notification", h, suppressed, err)
+	}
+}
+
+func TestSuppressorConcurrent(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, _ := newTestDispatcher(ctx, t, client)
+	ac := addTestAction(ctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+	addTestAssignment(ctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+	s := NewSuppressor(d, time.Hour)
+
+	// actions of the same callpoint arriving together create a single notification
+	ntIDs := make([]string, 4)
+	var wg sync.WaitGroup
+	for i := range ntIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h, _, err := s.Dispatch(ctx, ac)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ntIDs[i] = h.NtID
+		}(i)
+	}
+	wg.Wait()
+	for _, ntID := range ntIDs[1:] {
+		if ntID != ntIDs[0] {
+			t.Fatalf("notifications = %v, want a single one", ntIDs)
+		}
+	}
+	if stats := s.Stats(); stats.Dispatched != 1 || stats.Suppressed != 3 {
+		t.Fatalf("stats = %+v, want 1 dispatched and 3 suppressed", stats)
+	}
+	if len(s.locks) != 0 {
+		t.Fatalf("callpoint locks = %v, want none once done", s.locks)
+	}
+}
+
+func TestSuppressorTenants(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	d, _ := newTestDispatcher(ctx, t, client)
+	s := NewSuppressor(d, time.Hour)
+	// the same callpoint in two tenants
+	var ntIDs []string
+	for _, tenant := range []string{TenantFromContext(ctx), TenantFromContext(ctx) + "-other"} {
+		tctx := WithTenant(ctx, tenant)
+		ac := addTestAction(tctx, t, client, &dst.Callpoint{CpID: "cp-1"})
+		addTestAssignment(tctx, t, client, "cp-1", &dst.Device{DvID: "dv-1"}, 1)
+		h, suppressed, err := s.Dispatch(tctx, ac)
+		if err != nil || suppressed {
+			t.Fatalf("Dispatch in tenant %s = %v, %v; want dispatched", tenant, suppressed, err)
+		}
+		ntIDs = append(ntIDs, h.NtID)
+	}
+	if ntIDs[0] == ntIDs[1] {
+		t.Fatalf("both tenants share notification %s", ntIDs[0])
+	}
+}
+
+func TestSuppressorStatsCopy(t *testing.T) {
+	s := NewSuppressor(nil, time.Minute)
+	key := TenantCallpoint{CpID: "cp-1"}
+	s.stats.ByCallpoint[key] = 2
+	stats := s.Stats()
+	stats.ByCallpoint[key] = 5
+	if s.Stats().ByCallpoint[key] != 2 {
+		t.Fatal("changing the returned stats changed the suppressor")
+	}
+}
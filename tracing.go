@@ -0,0 +1,99 @@
+package gcp
+
+//This file will contain the tracing of the datastore and pubsub helpers
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name of the spans of the package
+const TracerName = "github.com/xallcloud/gcp"
+
+// keys of the span attributes
+const (
+	SpanAttrKind   = "gcp.kind"
+	SpanAttrFilter = "gcp.filter"
+	SpanAttrCount  = "gcp.count"
+	SpanAttrTenant = "gcp.tenant"
+)
+
+// noCount is passed to endSpan by the helpers that do not return a list
+const noCount = -1
+
+var pkgTracerProvider atomic.Value
+
+// tracerProvider holds the provider, as atomic.Value needs a consistent concrete type
+type tracerProvider struct {
+	trace.TracerProvider
+}
+
+// SetTracerProvider sets the provider of the spans of the package, such as one with an in-memory
+// exporter in tests. By default, or with nil, the global provider (otel.GetTracerProvider) is used.
+func SetTracerProvider(tp trace.TracerProvider) {
+	pkgTracerProvider.Store(tracerProvider{tp})
+}
+
+// tracer returns the tracer of the package
+func tracer() trace.Tracer {
+	if tp, ok := pkgTracerProvider.Load().(tracerProvider); ok && tp.TracerProvider != nil {
+		return tp.Tracer(TracerName)
+	}
+	return otel.GetTracerProvider().Tracer(TracerName)
+}
+
+// operation is a helper being traced and measured
+type operation struct {
+	span  trace.Span
+	name  string
+	kind  string
+	start time.Time
+}
+
+// startSpan starts the span of a helper, with the kind (a datastore kind, "topic" or "subscription")
+// and the filter, when not empty
+func startSpan(ctx context.Context, name, kind, filter string, opts ...trace.SpanStartOption) (context.Context, *operation) {
+	attrs := []attribute.KeyValue{attribute.String(SpanAttrKind, kind)}
+	if filter != "" {
+		attrs = append(attrs, attribute.String(SpanAttrFilter, filter))
+	}
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		attrs = append(attrs, attribute.String(SpanAttrTenant, tenant))
+	}
+	opts = append(opts, trace.WithAttributes(attrs...))
+	ctx, span := tracer().Start(ctx, name, opts...)
+	return ctx, &operation{span: span, name: name, kind: kind, start: time.Now()}
+}
+
+// endSpan records the number of results, unless noCount, and the error of the helper, ends the span
+// and measures the operation (see Metrics)
+func endSpan(op *operation, count int, err error) {
+	if count != noCount {
+		op.span.SetAttributes(attribute.Int(SpanAttrCount, count))
+	}
+	if err != nil {
+		op.span.RecordError(err)
+		op.span.SetStatus(codes.Error, err.Error())
+	}
+	op.span.End()
+	metrics().Operation(op.name, op.kind, outcome(err), time.Since(op.start))
+}
+
+// InjectTraceContext adds the trace context of ctx to the attributes of a message to be published,
+// with the global propagator (see otel.SetTextMapPropagator)
+func InjectTraceContext(ctx context.Context, attrs map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(attrs))
+}
+
+// ExtractTraceContext returns ctx with the trace context found in the attributes of a received message,
+// so the spans of the subscriber are children of the span that published it
+func ExtractTraceContext(ctx context.Context, attrs map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(attrs))
+}
@@ -0,0 +1,143 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// newTestTracer records the spans of the package in memory for the test
+func newTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	SetTracerProvider(tp)
+	t.Cleanup(func() {
+		SetTracerProvider(nil)
+		tp.Shutdown(context.Background())
+	})
+	return exp
+}
+
+// spanAttr returns the value of the attribute of the span, and if it is set
+func spanAttr(span tracetest.SpanStub, key string) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// findSpan returns the span with the name, failing the test if it was not recorded
+func findSpan(t *testing.T, exp *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range exp.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("span %s not recorded, got %d spans", name, len(exp.GetSpans()))
+	return tracetest.SpanStub{}
+}
+
+func TestSpans(t *testing.T) {
+	exp := newTestTracer(t)
+	ctx := WithTenant(context.Background(), "t-1")
+
+	_, op := startSpan(ctx, "DeviceGetByDvID", dst.KindDevices, "dvID = dv-1")
+	endSpan(op, 2, nil)
+	_, op = startSpan(ctx, "DeviceDelete", dst.KindDevices, "")
+	endSpan(op, noCount, errors.New("boom"))
+
+	span := findSpan(t, exp, "DeviceGetByDvID")
+	for key, want := range map[string]string{
+		SpanAttrKind:   dst.KindDevices,
+		SpanAttrFilter: "dvID = dv-1",
+		SpanAttrTenant: "t-1",
+	} {
+		if v, _ := spanAttr(span, key); v.AsString() != want {
+			t.Errorf("%s = %q, want %q", key, v.AsString(), want)
+		}
+	}
+	if v, ok := spanAttr(span, SpanAttrCount); !ok || v.AsInt64() != 2 {
+		t.Errorf("%s = %v, want 2", SpanAttrCount, v.AsInterface())
+	}
+	if span.Status.Code == codes.Error {
+		t.Errorf("status = %+v, want no error", span.Status)
+	}
+
+	span = findSpan(t, exp, "DeviceDelete")
+	if _, ok := spanAttr(span, SpanAttrCount); ok {
+		t.Errorf("%s set with noCount", SpanAttrCount)
+	}
+	if _, ok := spanAttr(span, SpanAttrFilter); ok {
+		t.Errorf("%s set without filter", SpanAttrFilter)
+	}
+	if span.Status.Code != codes.Error || span.Status.Description != "boom" {
+		t.Errorf("status = %+v, want error boom", span.Status)
+	}
+	if len(span.Events) != 1 || span.Events[0].Name != "exception" {
+		t.Errorf("events = %+v, want the error recorded", span.Events)
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	exp := newTestTracer(t)
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+
+	ctx, publish := startSpan(context.Background(), "publish", "topic", "", trace.WithSpanKind(trace.SpanKindProducer))
+	attrs := map[string]string{AttrKind: MessageKindNotification}
+	InjectTraceContext(ctx, attrs)
+	endSpan(publish, noCount, nil)
+	if attrs["traceparent"] == "" {
+		t.Fatalf("attributes = %v, want the trace context", attrs)
+	}
+
+	_, receive := startSpan(ExtractTraceContext(context.Background(), attrs), "receive", "subscription", "",
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	endSpan(receive, noCount, nil)
+
+	parent := findSpan(t, exp, "publish")
+	child := findSpan(t, exp, "receive")
+	if child.Parent.TraceID() != parent.SpanContext.TraceID() || child.Parent.SpanID() != parent.SpanContext.SpanID() {
+		t.Fatalf("receive parent = %v, want the publish span %v", child.Parent, parent.SpanContext)
+	}
+	if !child.Parent.IsRemote() {
+		t.Errorf("receive parent is not remote")
+	}
+}
+
+func TestHelperSpans(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	exp := newTestTracer(t)
+	n := addTestNotification(ctx, t, client)
+
+	notifications, err := NotificationGetByNtID(ctx, client, n.NtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := findSpan(t, exp, "NotificationGetByNtID")
+	if v, _ := spanAttr(span, SpanAttrKind); v.AsString() != dst.KindNotifications {
+		t.Errorf("%s = %q, want %s", SpanAttrKind, v.AsString(), dst.KindNotifications)
+	}
+	if v, _ := spanAttr(span, SpanAttrCount); v.AsInt64() != int64(len(notifications)) || len(notifications) != 1 {
+		t.Errorf("%s = %d with %d notifications, want 1", SpanAttrCount, v.AsInt64(), len(notifications))
+	}
+	if v, _ := spanAttr(span, SpanAttrTenant); v.AsString() != TenantFromContext(ctx) {
+		t.Errorf("%s = %q, want %q", SpanAttrTenant, v.AsString(), TenantFromContext(ctx))
+	}
+	findSpan(t, exp, "NotificationAdd")
+}
@@ -0,0 +1,256 @@
+package gcp
+
+//This file will contain the validation of the entities before they are stored
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// FieldError is a validation error of a single field
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError has all the field errors of an entity
+type ValidationError struct {
+	Kind   string
+	Errors []FieldError
+}
+
+// Error lists the field errors, with the field path of each
+func (v *ValidationError) Error() string {
+	msgs := make([]string, len(v.Errors))
+	for i, e := range v.Errors {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return fmt.Sprintf("invalid %s. %s", v.Kind, strings.Join(msgs, "; "))
+}
+
+// add appends a field error
+func (v *ValidationError) add(field, format string, args ...interface{}) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the validation error, or nil if there are no field errors
+func (v *ValidationError) err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+	return v
+}
+
+type skipReferencesKey struct{}
+
+// SkipReferenceChecks returns a context for the Add helpers that does not check if the referenced
+// callpoints and devices exist, for bulk imports where they are stored in any order.
+func SkipReferenceChecks(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipReferencesKey{}, true)
+}
+
+// checkReferences reports if the references must be checked with the context
+func checkReferences(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipReferencesKey{}).(bool)
+	return !skip
+}
+
+// ValidateCallpoint checks the callpoint fields
+func ValidateCallpoint(cp *dst.Callpoint) error {
+	v := &ValidationError{Kind: "callpoint"}
+	requireID(v, "cpID", cp.CpID)
+	if strings.HasPrefix(cp.CpID, AddressTargetPrefix) {
+		v.add("cpID", "must not start with %s", AddressTargetPrefix)
+	}
+	if cp.Priority < 0 {
+		v.add("priority", "must not be negative, got %d", cp.Priority)
+	}
+	validJSON(v, "rawRequest", cp.RawRequest)
+	return v.err()
+}
+
+// ValidateDevice checks the device fields
+func ValidateDevice(dv *dst.Device) error {
+	v := &ValidationError{Kind: "device"}
+	requireID(v, "dvID", dv.DvID)
+	if _, group := GroupTargetID(dv.DvID); group {
+		v.add("dvID", "must not start with %s", GroupTargetPrefix)
+	}
+	if dv.Priority < 0 {
+		v.add("priority", "must not be negative, got %d", dv.Priority)
+	}
+	// settings of a registered type are checked against their struct, the others only as JSON
+	if err := ValidateDeviceSettings(dv); err != nil {
+		v.add("settings", "%v", err)
+	} else {
+		validJSON(v, "settings", dv.Settings)
+	}
+	validJSON(v, "rawRequest", dv.RawRequest)
+	return v.err()
+}
+
+// ValidateAssignment checks the assignment fields and, unless the context skips them,
+// that its callpoint (or address node) and device (or device group) exist.
+func ValidateAssignment(ctx context.Context, client *datastore.Client, asgn *dst.Assignment) error {
+	v := &ValidationError{Kind: "assignment"}
+	requireID(v, "asID", asgn.AsID)
+	requireID(v, "cpID", asgn.CpID)
+	requireID(v, "dvID", asgn.DvID)
+	if asgn.Level < 0 {
+		v.add("level", "must not be negative, got %d", asgn.Level)
+	}
+	// registered settings are checked against their struct, the others only as JSON
+	if err := ValidateAssignmentSettings(asgn); err != nil {
+		v.add("settings", "%v", err)
+	} else {
+		validJSON(v, "settings", asgn.Settings)
+	}
+	validJSON(v, "rawRequest", asgn.RawRequest)
+	if len(v.Errors) > 0 || !checkReferences(ctx) {
+		return v.err()
+	}
+	if !strings.HasPrefix(asgn.CpID, AddressTargetPrefix) {
+		cps, err := CallpointGetByCpID(ctx, client, asgn.CpID)
+		if err != nil {
+			return err
+		}
+		if len(cps) <= 0 {
+			v.add("cpID", "callpoint %s does not exist", asgn.CpID)
+		}
+	}
+	if grID, ok := GroupTargetID(asgn.DvID); ok {
+		groups, err := DeviceGroupGetByGrID(ctx, client, grID)
+		if err != nil {
+			return err
+		}
+		if len(groups) <= 0 {
+			v.add("dvID", "device group %s does not exist", grID)
+		}
+	} else {
+		dvs, err := DeviceGetByDvID(ctx, client, asgn.DvID)
+		if err != nil {
+			return err
+		}
+		if len(dvs) <= 0 {
+			v.add("dvID", "device %s does not exist", asgn.DvID)
+		}
+	}
+	return v.err()
+}
+
+// ValidateAction checks the action fields and, unless the context skips it, that its callpoint exists
+func ValidateAction(ctx context.Context, client *datastore.Client, ac *dst.Action) error {
+	v := &ValidationError{Kind: "action"}
+	requireID(v, "acID", ac.AcID)
+	requireID(v, "cpID", ac.CpID)
+	validJSON(v, "rawRequest", ac.RawRequest)
+	if len(v.Errors) > 0 || !checkReferences(ctx) {
+		return v.err()
+	}
+	cps, err := CallpointGetByCpID(ctx, client, ac.CpID)
+	if err != nil {
+		return err
+	}
+	if len(cps) <= 0 {
+		v.add("cpID", "callpoint %s does not exist", ac.CpID)
+	}
+	return v.err()
+}
+
+// ValidateNotification checks the notification fields
+func ValidateNotification(n *dst.Notification) error {
+	v := &ValidationError{Kind: "notification"}
+	requireID(v, "acID", n.AcID)
+	if n.Priority < 0 {
+		v.add("priority", "must not be negative, got %d", n.Priority)
+	}
+	// options are a JSON array or a comma separated list, see NotificationOptions
+	if raw := strings.TrimSpace(n.Options); strings.HasPrefix(raw, "[") {
+		var options []string
+		if err := json.Unmarshal([]byte(raw), &options); err != nil {
+			v.add("options", "is not a JSON array of strings")
+		}
+	}
+	return v.err()
+}
+
+// ValidateEvent checks the event fields. An empty visibility is allowed, and stored as VisibilityAll
+func ValidateEvent(ev *dst.Event) error {
+	v := &ValidationError{Kind: "event"}
+	if ev.NtID == "" && ev.CpID == "" {
+		v.add("ntID", "is required when there is no cpID")
+	}
+	if ev.EvType == "" {
+		v.add("evType", "is required")
+	}
+	if ev.Visibility != "" && ev.Visibility != VisibilityAll && ev.Visibility != VisibilityServer {
+		v.add("visibility", "must be %s or %s, got '%s'", VisibilityAll, VisibilityServer, ev.Visibility)
+	}
+	return v.err()
+}
+
+// ValidateDeviceGroup checks the device group fields
+func ValidateDeviceGroup(gr *DeviceGroup) error {
+	v := &ValidationError{Kind: "device group"}
+	requireID(v, "grID", gr.GrID)
+	for i, m := range gr.Members {
+		if strings.TrimSpace(m) == "" {
+			v.add(fmt.Sprintf("members[%d]", i), "must not be empty")
+		}
+	}
+	return v.err()
+}
+
+// ValidateDeviceSchedule checks the timezone, the clock times of the rules and the periods of the exceptions
+func ValidateDeviceSchedule(s *DeviceSchedule) error {
+	v := &ValidationError{Kind: "device schedule"}
+	requireID(v, "dvID", s.DvID)
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			v.add("timezone", "unknown timezone '%s'", s.Timezone)
+		}
+	}
+	for i, r := range s.Rules {
+		if r.Weekday < time.Sunday || r.Weekday > time.Saturday {
+			v.add(fmt.Sprintf("rules[%d].weekday", i), "must be from 0 (Sunday) to 6, got %d", r.Weekday)
+		}
+		if _, err := time.Parse("15:04", r.Start); err != nil {
+			v.add(fmt.Sprintf("rules[%d].start", i), "must be a 15:04 clock time, got '%s'", r.Start)
+		}
+		if _, err := time.Parse("15:04", r.End); err != nil {
+			v.add(fmt.Sprintf("rules[%d].end", i), "must be a 15:04 clock time, got '%s'", r.End)
+		}
+	}
+	for i, e := range s.Exceptions {
+		if !e.To.After(e.From) {
+			v.add(fmt.Sprintf("exceptions[%d].to", i), "must be after from")
+		}
+	}
+	return v.err()
+}
+
+// requireID adds an error if the business ID is empty or has surrounding spaces
+func requireID(v *ValidationError, field, id string) {
+	if id == "" {
+		v.add(field, "is required")
+	} else if strings.TrimSpace(id) != id {
+		v.add(field, "must not have surrounding spaces")
+	}
+}
+
+// validJSON adds an error if the value is not empty and not valid JSON, as it is written raw in the JSON output
+func validJSON(v *ValidationError, field, value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+	if !json.Valid([]byte(value)) {
+		v.add(field, "is not valid JSON")
+	}
+}
@@ -0,0 +1,63 @@
+package gcp
+
+import (
+	"errors"
+	"testing"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+func TestValidateCallpoint(t *testing.T) {
+	if err := ValidateCallpoint(&dst.Callpoint{CpID: "cp-1"}); err != nil {
+		t.Fatal(err)
+	}
+	// a cpID like an address target would be taken for the address node by the assignments
+	err := ValidateCallpoint(&dst.Callpoint{CpID: AddressTarget("site/building")})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Errors[0].Field != "cpID" {
+		t.Fatalf("ValidateCallpoint of an address target = %v, want a cpID error", err)
+	}
+}
+
+func TestValidateNotification(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       dst.Notification
+		wantErr bool
+	}{
+		{"valid", dst.Notification{AcID: "ac-1", Priority: 2, Options: "OK,NO"}, false},
+		{"json options", dst.Notification{AcID: "ac-1", Options: `["OK", "NO"]`}, false},
+		{"no acID", dst.Notification{Options: "OK"}, true},
+		{"negative priority", dst.Notification{AcID: "ac-1", Priority: -1}, true},
+		{"broken json options", dst.Notification{AcID: "ac-1", Options: `["OK", `}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateNotification(&tt.n); (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateNotification = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		ev      dst.Event
+		wantErr bool
+	}{
+		{"valid", dst.Event{NtID: "nt-1", Visibility: VisibilityAll, EvType: EvTypeDevices}, false},
+		{"callpoint event", dst.Event{CpID: "cp-1", Visibility: VisibilityServer, EvType: EvTypeServices}, false},
+		{"no ntID nor cpID", dst.Event{Visibility: VisibilityAll, EvType: EvTypeDevices}, true},
+		{"no evType", dst.Event{NtID: "nt-1", Visibility: VisibilityAll}, true},
+		{"empty visibility", dst.Event{NtID: "nt-1", EvType: EvTypeDevices}, false},
+		{"unknown visibility", dst.Event{NtID: "nt-1", Visibility: "everyone", EvType: EvTypeDevices}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateEvent(&tt.ev); (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateEvent = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package gcp
+
+//This file will contain the watchdog that times out the devices that are not reached in time
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// Clock returns the current time. It is replaced in tests to control time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// TimeoutPolicy has the time allowed to reach a device.
+// A "timeoutSeconds" value in Device.Settings has precedence over the priority and default timeouts.
+type TimeoutPolicy struct {
+	Default    time.Duration
+	ByPriority map[int]time.Duration
+}
+
+// timeoutSettings is the part of Device.Settings read by the watchdog
+type timeoutSettings struct {
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// timeout returns the time allowed to reach the device
+func (p TimeoutPolicy) timeout(dv *dst.Device) time.Duration {
+	settings, err := DeviceSettingsAs[timeoutSettings](dv)
+	if err == nil && settings.TimeoutSeconds > 0 {
+		return time.Duration(settings.TimeoutSeconds) * time.Second
+	}
+	if t, ok := p.ByPriority[dv.Priority]; ok {
+		return t
+	}
+	return p.Default
+}
+
+// EscalateFunc reaches the devices of the given level of a notification, or of the next level with devices,
+// such as Dispatcher.Escalate. It returns nil when there is no such level.
+type EscalateFunc func(ctx context.Context, ntID string, level int) (*Escalation, error)
+
+// Watchdog tracks the devices being reached and emits a timeout event for the ones not reached in time
+type Watchdog struct {
+	ds       *datastore.Client
+	policy   TimeoutPolicy
+	escalate EscalateFunc
+	clock    Clock
+
+	mu        sync.Mutex
+	reaching  map[string]*watch
+	escalated map[string]int
+}
+
+// watch is a device being reached for a notification
+type watch struct {
+	tenant   string
+	ntID     string
+	dvID     string
+	dvType   int
+	level    int
+	deadline time.Time
+	// timedOut is set once the timeout event is recorded, so a retried watch only escalates
+	timedOut bool
+}
+
+// NewWatchdog returns a watchdog. escalate is optional, when nil timeouts are not escalated.
+func NewWatchdog(ds *datastore.Client, policy TimeoutPolicy, escalate EscalateFunc) *Watchdog {
+	return &Watchdog{
+		ds:        ds,
+		policy:    policy,
+		escalate:  escalate,
+		clock:     systemClock{},
+		reaching:  make(map[string]*watch),
+		escalated: make(map[string]int),
+	}
+}
+
+// SetClock replaces the clock used for deadlines
+func (w *Watchdog) SetClock(c Clock) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.clock = c
+}
+
+// Reaching starts tracking a device that is being reached at the given escalation level.
+// The tenant of the context is kept, to record the timeout in the same tenant.
+func (w *Watchdog) Reaching(ctx context.Context, ntID string, dv *dst.Device, level int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reaching[ntID+"/"+dv.DvID] = &watch{
+		tenant:   TenantFromContext(ctx),
+		ntID:     ntID,
+		dvID:     dv.DvID,
+		dvType:   dv.Type,
+		level:    level,
+		deadline: w.clock.Now().Add(w.policy.timeout(dv)),
+	}
+}
+
+// Done stops tracking a device, once it was delivered, failed or replied
+func (w *Watchdog) Done(ntID, dvID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.reaching, ntID+"/"+dvID)
+	w.forgetIdle(ntID)
+}
+
+// forgetIdle forgets the escalation level of the notification once none of its devices is tracked,
+// as nothing can escalate it anymore. Must be called with the lock held
+func (w *Watchdog) forgetIdle(ntID string) {
+	for _, wt := range w.reaching {
+		if wt.ntID == ntID {
+			return
+		}
+	}
+	delete(w.escalated, ntID)
+}
+
+// Forget stops tracking all the devices of a notification, once it was closed
+func (w *Watchdog) Forget(ntID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for k, wt := range w.reaching {
+		if wt.ntID == ntID {
+			delete(w.reaching, k)
+		}
+	}
+	delete(w.escalated, ntID)
+}
+
+// Pending returns the number of devices being tracked
+func (w *Watchdog) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.reaching)
+}
+
+// Check emits a timeout event for each device past its deadline and escalates its notification
+// to the next level, unless a device already replied to it or it was closed. The devices reached
+// by the escalation are tracked at their level, so they are escalated in turn.
+func (w *Watchdog) Check(ctx context.Context) error {
+	w.mu.Lock()
+	now := w.clock.Now()
+	var expired []*watch
+	for k, wt := range w.reaching {
+		if now.After(wt.deadline) {
+			expired = append(expired, wt)
+			delete(w.reaching, k)
+		}
+	}
+	w.mu.Unlock()
+
+	for i, wt := range expired {
+		if err := w.expire(ctx, wt); err != nil {
+			// the watches not handled yet are checked again on the next call
+			w.requeue(expired[i:])
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, wt := range expired {
+		w.forgetIdle(wt.ntID)
+	}
+	return nil
+}
+
+// expire records the timeout of the device and escalates its notification
+func (w *Watchdog) expire(ctx context.Context, wt *watch) error {
+	ctx = WithTenant(ctx, wt.tenant)
+	if !wt.timedOut {
+		logger().InfoContext(ctx, "device timeout", LogKeyOp, "Watchdog", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, wt.ntID, "dvID", wt.dvID, LogKeyTenant, wt.tenant)
+		_, err := EventAdd(ctx, w.ds, &dst.Event{
+			NtID:          wt.ntID,
+			DvID:          wt.dvID,
+			Visibility:    VisibilityAll,
+			EvType:        EvTypeDevices,
+			EvSubType:     EvSubTypeTimeout,
+			EvDescription: fmt.Sprintf("not reached at level %d", wt.level),
+		})
+		if errors.Is(err, ErrNotificationClosed) {
+			w.Forget(wt.ntID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		metrics().DeviceOutcome(wt.dvType, EvSubTypeTimeout)
+		wt.timedOut = true
+	}
+	return w.escalateOnce(ctx, wt.ntID, wt.level+1)
+}
+
+// requeue tracks the watches again, unless the device is already tracked again
+func (w *Watchdog) requeue(watches []*watch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, wt := range watches {
+		key := wt.ntID + "/" + wt.dvID
+		if _, ok := w.reaching[key]; !ok {
+			w.reaching[key] = wt
+		}
+	}
+}
+
+// escalateOnce escalates the notification to the level, if it was not escalated to it yet
+func (w *Watchdog) escalateOnce(ctx context.Context, ntID string, level int) error {
+	if w.escalate == nil {
+		return nil
+	}
+	w.mu.Lock()
+	last, ok := w.escalated[ntID]
+	w.mu.Unlock()
+	if ok && last >= level {
+		return nil
+	}
+
+	closed, err := NotificationClosed(ctx, w.ds, ntID)
+	if err != nil {
+		return err
+	}
+	replied, err := NotificationReplied(ctx, w.ds, ntID)
+	if err != nil {
+		return err
+	}
+	if closed || replied {
+		logger().InfoContext(ctx, "notification closed or replied, no escalation", LogKeyOp, "Watchdog", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, ntID)
+		w.Forget(ntID)
+		return nil
+	}
+	esc, err := w.escalate(ctx, ntID, level)
+	if err != nil {
+		return err
+	}
+	if esc == nil {
+		esc = &Escalation{Level: level}
+	}
+	// the level is recorded only once reached, so a failed escalation is retried
+	w.mu.Lock()
+	if w.escalated[ntID] < esc.Level {
+		w.escalated[ntID] = esc.Level
+	}
+	w.mu.Unlock()
+	for _, dv := range esc.Devices {
+		w.Reaching(ctx, ntID, dv, esc.Level)
+	}
+	logger().InfoContext(ctx, "notification escalated", LogKeyOp, "Watchdog", LogKeyKind, dst.KindNotifications, LogKeyBusinessID, ntID, "level", esc.Level, LogKeyCount, len(esc.Devices))
+	return nil
+}
+
+// Run checks the deadlines at every interval until the context is done
+func (w *Watchdog) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := w.Check(ctx); err != nil {
+				logger().ErrorContext(ctx, "check failed", LogKeyOp, "Watchdog", LogKeyError, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dst "github.com/xallcloud/api/datastore"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// escalations records the levels a watchdog escalated to, failing while err is set.
+// Each level reached has a single device, "dv-level-<level>"; the levels in skip have no device.
+type escalations struct {
+	levels []int
+	skip   map[int]bool
+	err    error
+}
+
+func (e *escalations) escalate(ctx context.Context, ntID string, level int) (*Escalation, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	for e.skip[level] {
+		level++
+	}
+	e.levels = append(e.levels, level)
+	return &Escalation{Level: level, Devices: []*dst.Device{{DvID: fmt.Sprintf("dv-level-%d", level)}}}, nil
+}
+
+// newTestWatchdog returns a watchdog with a 30s timeout and a fake clock
+func newTestWatchdog(client *datastore.Client) (*Watchdog, *fakeClock, *escalations) {
+	esc := &escalations{}
+	clock := newFakeClock()
+	w := NewWatchdog(client, TimeoutPolicy{Default: 30 * time.Second}, esc.escalate)
+	w.SetClock(clock)
+	return w, clock, esc
+}
+
+// timeouts counts the timeout events of the device
+func timeouts(ctx context.Context, t *testing.T, client *datastore.Client, ntID, dvID string) int {
+	t.Helper()
+	events, err := EventsGetByNtID(ctx, client, ntID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, e := range events {
+		if e.DvID == dvID && e.EvSubType == EvSubTypeTimeout {
+			count++
+		}
+	}
+	return count
+}
+
+func TestWatchdogExpiry(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	w, clock, esc := newTestWatchdog(client)
+
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-1"}, 1)
+	clock.Advance(29 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if w.Pending() != 1 || len(esc.levels) != 0 {
+		t.Fatalf("before the deadline: pending %d, escalations %v", w.Pending(), esc.levels)
+	}
+	clock.Advance(2 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if w.Pending() != 0 {
+		t.Fatalf("after the deadline: pending %d, want 0", w.Pending())
+	}
+	if got := timeouts(ctx, t, client, n.NtID, "dv-1"); got != 1 {
+		t.Fatalf("timeout events = %d, want 1", got)
+	}
+	if len(esc.levels) != 1 || esc.levels[0] != 2 {
+		t.Fatalf("escalations = %v, want [2]", esc.levels)
+	}
+}
+
+func TestWatchdogEscalatesOncePerLevel(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	w, clock, esc := newTestWatchdog(client)
+
+	// two devices of the same level time out together, then another one later
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-1"}, 1)
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-2"}, 1)
+	clock.Advance(31 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-3"}, 1)
+	clock.Advance(31 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(esc.levels) != 1 || esc.levels[0] != 2 {
+		t.Fatalf("escalations = %v, want [2]", esc.levels)
+	}
+	// the device reached at level 2 is tracked, and escalates to level 3 in turn
+	clock.Advance(31 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(esc.levels) != 2 || esc.levels[1] != 3 {
+		t.Fatalf("escalations = %v, want [2 3]", esc.levels)
+	}
+	if got := timeouts(ctx, t, client, n.NtID, "dv-level-2"); got != 1 {
+		t.Fatalf("timeout events of the escalated device = %d, want 1", got)
+	}
+}
+
+func TestWatchdogTracksEscalatedLevel(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	w, clock, esc := newTestWatchdog(client)
+	esc.skip = map[int]bool{2: true, 3: true}
+
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-1"}, 1)
+	clock.Advance(31 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// another device of level 1 does not escalate again once level 4 was reached
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-2"}, 1)
+	clock.Advance(31 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(esc.levels) != 2 || esc.levels[0] != 4 || esc.levels[1] != 5 {
+		t.Fatalf("escalations = %v, want [4 5]", esc.levels)
+	}
+}
+
+func TestWatchdogForgetsEndedNotifications(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	w, clock, _ := newTestWatchdog(client)
+
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-1"}, 1)
+	clock.Advance(31 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.escalated) != 1 {
+		t.Fatalf("escalated = %v, want the notification", w.escalated)
+	}
+	w.Done(n.NtID, "dv-level-2")
+	if w.Pending() != 0 || len(w.escalated) != 0 {
+		t.Fatalf("after the last device is done: pending %d, escalated %v; want none", w.Pending(), w.escalated)
+	}
+}
+
+func TestWatchdogRetriesFailedEscalation(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	w, clock, esc := newTestWatchdog(client)
+
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-1"}, 1)
+	clock.Advance(31 * time.Second)
+	esc.err = errors.New("pubsub unavailable")
+	if err := w.Check(ctx); !errors.Is(err, esc.err) {
+		t.Fatalf("Check = %v, want %v", err, esc.err)
+	}
+	if w.Pending() != 1 {
+		t.Fatalf("pending after a failed escalation = %d, want 1", w.Pending())
+	}
+	esc.err = nil
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(esc.levels) != 1 || esc.levels[0] != 2 {
+		t.Fatalf("escalations = %v, want [2]", esc.levels)
+	}
+	// the retry does not record the timeout again
+	if got := timeouts(ctx, t, client, n.NtID, "dv-1"); got != 1 {
+		t.Fatalf("timeout events = %d, want 1", got)
+	}
+}
+
+func TestWatchdogNoEscalationAfterReply(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	w, clock, esc := newTestWatchdog(client)
+
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-1"}, 1)
+	_, err := EventAdd(ctx, client, &dst.Event{NtID: n.NtID, DvID: "dv-2", EvType: EvTypeDevices, EvSubType: EvSubTypeReply, EvDescription: "OK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(31 * time.Second)
+	if err = w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(esc.levels) != 0 {
+		t.Fatalf("escalations after a reply = %v, want none", esc.levels)
+	}
+}
+
+func TestWatchdogNoEscalationAfterClose(t *testing.T) {
+	ctx, client := newTestDatastore(t)
+	n := addTestNotification(ctx, t, client)
+	w, clock, esc := newTestWatchdog(client)
+
+	w.Reaching(ctx, n.NtID, &dst.Device{DvID: "dv-1"}, 1)
+	if err := NotificationClose(ctx, client, n.NtID, EvSubTypeCancelled); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(31 * time.Second)
+	if err := w.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(esc.levels) != 0 || w.Pending() != 0 {
+		t.Fatalf("after close: escalations %v, pending %d; want none", esc.levels, w.Pending())
+	}
+}